@@ -0,0 +1,39 @@
+//go:build linux
+
+package nsca
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// unacknowledged returns the number of bytes written to conn that the peer has not yet
+// acknowledged (for TCP) or read (for unix sockets), using the SIOCOUTQ ioctl.
+func unacknowledged(conn net.Conn) (int, error) {
+	if c, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		// look through TLS to the socket
+		conn = c.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, fmt.Errorf("ConfirmTCPAck needs a socket connection")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var n int32
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCOUTQ, uintptr(unsafe.Pointer(&n)))
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package nsca
+
+import (
+	"fmt"
+	"net"
+)
+
+func unacknowledged(conn net.Conn) (int, error) {
+	return 0, fmt.Errorf("ConfirmTCPAck is not supported on this platform")
+}
@@ -0,0 +1,53 @@
+package nsca
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrBreakerOpen is reported for messages that an endpoint did not attempt to send because
+// its circuit breaker is open (see ServerInfo.BreakerThreshold).
+var ErrBreakerOpen = errors.New("NSCA circuit breaker is open")
+
+// defaultBreakerCooldown is used when BreakerThreshold is set without BreakerCooldown.
+const defaultBreakerCooldown = 30 * time.Second
+
+// breaker is an endpoint's circuit breaker. After BreakerThreshold consecutive failures it
+// opens, and messages fail with ErrBreakerOpen until the cooldown has passed. The next
+// message is then sent as a trial: success closes the breaker, failure opens it again.
+type breaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// allow reports whether a message may be sent.
+func (b *breaker) allow(info ServerInfo) bool {
+	if info.BreakerThreshold <= 0 || b.openUntil.IsZero() {
+		return true
+	}
+	return !info.now().Before(b.openUntil)
+}
+
+// record updates the breaker with the result of a send.
+func (b *breaker) record(info ServerInfo, err error) {
+	if info.BreakerThreshold <= 0 {
+		return
+	}
+	if err == nil {
+		if !b.openUntil.IsZero() {
+			info.logf("NSCA circuit breaker closed")
+		}
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures >= info.BreakerThreshold {
+		cooldown := info.BreakerCooldown
+		if cooldown <= 0 {
+			cooldown = defaultBreakerCooldown
+		}
+		b.openUntil = info.now().Add(cooldown)
+		info.logf("NSCA circuit breaker opened for %s after %d consecutive failures: %s", cooldown, b.failures, err)
+	}
+}
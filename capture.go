@@ -0,0 +1,74 @@
+package nsca
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// CaptureSend runs the full NSCA send path against an in-memory connection instead of a
+// real server. The client end of a net.Pipe is handed an initialization packet built from
+// iv and timestamp, each message is sent with NSCAServer.Send, and the bytes written to
+// the pipe are returned. The Host, Port and Timeout fields of connectInfo are ignored.
+// CaptureSend is intended for tests, both in this package and downstream.
+func CaptureSend(connectInfo ServerInfo, iv []byte, timestamp uint32, messages ...*Message) ([]byte, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+	captured := make(chan []byte, 1)
+	go func() {
+		init := make([]byte, InitIVLength)
+		copy(init, iv)
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.BigEndian, init)
+		binary.Write(buf, binary.BigEndian, timestamp)
+		_, err := server.Write(buf.Bytes())
+		if err != nil {
+			captured <- nil
+			return
+		}
+		b, _ := io.ReadAll(server)
+		captured <- b
+	}()
+	n := new(NSCAServer)
+	connectInfo.Timeout = 0
+	err := n.handshake(client, connectInfo)
+	if err != nil {
+		server.Close()
+		<-captured
+		return nil, err
+	}
+	for _, m := range messages {
+		err = n.Send(m)
+		if err != nil {
+			n.Close()
+			<-captured
+			return nil, err
+		}
+	}
+	n.Close()
+	return <-captured, nil
+}
+
+// NewServerFromInitPacket returns an NSCAServer whose session is set up from initPacket,
+// a complete initialization packet captured from a real daemon (for example with
+// tcpdump), without any network connection. Packets sent with it are encoded and
+// encrypted exactly as for a live connection with that packet, and written to
+// connectInfo.DryRunOutput, or discarded if it is nil. Comparing them with the data
+// packets of the same capture checks the encryption against the daemon offline; keep in
+// mind that the unused bytes of each field are random, so compare decrypted fields rather
+// than raw bytes. The other connection settings of connectInfo are ignored.
+func NewServerFromInitPacket(connectInfo ServerInfo, initPacket []byte) (*NSCAServer, error) {
+	_, err := parseInitializationPacket(initPacket)
+	if err != nil {
+		return nil, err
+	}
+	conn := &dryRunConn{init: bytes.NewReader(initPacket), sink: connectInfo.DryRunOutput}
+	n := new(NSCAServer)
+	connectInfo.Timeout = 0
+	err = n.handshake(conn, connectInfo)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
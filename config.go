@@ -0,0 +1,112 @@
+package nsca
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ConfigFromEnv builds a ServerInfo from environment variables named prefix followed by
+// an underscore and the setting:
+//   - <PREFIX>_HOST: Host (required)
+//   - <PREFIX>_PORT: Port (required)
+//   - <PREFIX>_PASSWORD: Password (required unless the encryption is "none")
+//   - <PREFIX>_ENCRYPTION: EncryptionMethod, in any form ParseEncryptionMethod accepts
+//     (default "none")
+//   - <PREFIX>_TIMEOUT: Timeout, in the form time.ParseDuration accepts (for example
+//     "10s"; default no timeout)
+//
+// A missing required variable, or a value that cannot be parsed, is an error naming the
+// variable. Other fields of the result are left at their zero values.
+func ConfigFromEnv(prefix string) (ServerInfo, error) {
+	var info ServerInfo
+	env := func(name string, required bool) (string, string, error) {
+		key := prefix + "_" + name
+		value, ok := os.LookupEnv(key)
+		if required && (!ok || value == "") {
+			return key, "", fmt.Errorf("Missing environment variable %s", key)
+		}
+		return key, value, nil
+	}
+	var err error
+	_, info.Host, err = env("HOST", true)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	_, info.Port, err = env("PORT", true)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	key, value, _ := env("ENCRYPTION", false)
+	if value != "" {
+		info.EncryptionMethod, err = ParseEncryptionMethod(value)
+		if err != nil {
+			return ServerInfo{}, fmt.Errorf("Bad environment variable %s: %w", key, err)
+		}
+	}
+	_, info.Password, err = env("PASSWORD", info.EncryptionMethod != ENCRYPT_NONE)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	key, value, _ = env("TIMEOUT", false)
+	if value != "" {
+		info.Timeout, err = time.ParseDuration(value)
+		if err != nil {
+			return ServerInfo{}, fmt.Errorf("Bad environment variable %s: %w", key, err)
+		}
+	}
+	return info, nil
+}
+
+// ParseURL builds a ServerInfo from a connection string of the form
+//
+//	nsca://:password@host:port?encryption=name&timeout=duration
+//
+// The password goes in the password part of the user information; percent-encode any
+// special characters in it. The query parameters are optional:
+//   - encryption: EncryptionMethod, in any form ParseEncryptionMethod accepts (default
+//     "none")
+//   - timeout: Timeout, in the form time.ParseDuration accepts
+//   - network: Network, "tcp" (the default), "tcp4" or "tcp6"
+//
+// Unknown parameters are an error, so that a misspelled one is not silently ignored.
+// Other fields of the result are left at their zero values.
+func ParseURL(s string) (ServerInfo, error) {
+	var info ServerInfo
+	u, err := url.Parse(s)
+	if err != nil {
+		return info, err
+	}
+	if u.Scheme != "nsca" {
+		return info, fmt.Errorf("Bad NSCA URL scheme %q, expected \"nsca\"", u.Scheme)
+	}
+	info.Host = u.Hostname()
+	info.Port = u.Port()
+	if info.Port == "" {
+		return info, fmt.Errorf("NSCA URL %q has no port", u.Redacted())
+	}
+	if password, ok := u.User.Password(); ok {
+		info.Password = password
+	}
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "encryption":
+			info.EncryptionMethod, err = ParseEncryptionMethod(value)
+		case "timeout":
+			info.Timeout, err = time.ParseDuration(value)
+		case "network":
+			if value != "tcp" && value != "tcp4" && value != "tcp6" {
+				err = fmt.Errorf("Unsupported network %q", value)
+			}
+			info.Network = value
+		default:
+			err = fmt.Errorf("Unknown parameter")
+		}
+		if err != nil {
+			return ServerInfo{}, fmt.Errorf("Bad NSCA URL parameter %s: %w", key, err)
+		}
+	}
+	return info, nil
+}
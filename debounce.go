@@ -0,0 +1,78 @@
+package nsca
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrDebounced is reported on the Status channel of a message that was not sent because a
+// newer message for the same host and service arrived while it was held back by
+// ServerInfo.MinInterval.
+var ErrDebounced = errors.New("Message replaced by a newer message within the minimum interval")
+
+// debouncer holds back messages for a host and service that arrive within MinInterval of
+// the last one sent, keeping only the newest.
+type debouncer struct {
+	lastSent map[CheckTarget]time.Time
+	pending  map[CheckTarget]*Message
+	stop     func()           // stops the timer behind wait; nil if none
+	wait     <-chan time.Time // fires when the earliest pending message is due; nil if none
+}
+
+// admit reports whether m may be sent now. Otherwise m is held until its interval has
+// passed, replacing any message already held for the same host and service.
+func (e *Endpoint) admit(m *Message) bool {
+	d := &e.debounce
+	if d.lastSent == nil {
+		d.lastSent = make(map[CheckTarget]time.Time)
+		d.pending = make(map[CheckTarget]*Message)
+	}
+	key := m.Target()
+	now := e.info.now()
+	if old := d.pending[key]; old != nil {
+		d.pending[key] = m
+		e.report(old, ErrDebounced)
+		return false
+	}
+	if last, ok := d.lastSent[key]; ok && now.Sub(last) < e.info.MinInterval {
+		d.pending[key] = m
+		e.resetDebounceTimer()
+		return false
+	}
+	d.lastSent[key] = now
+	return true
+}
+
+// flushDebounced sends the held messages that are due, or all of them if all is set.
+func (e *Endpoint) flushDebounced(all bool) {
+	d := &e.debounce
+	now := e.info.now()
+	for key, m := range d.pending {
+		if !all && now.Sub(d.lastSent[key]) < e.info.MinInterval {
+			continue
+		}
+		delete(d.pending, key)
+		d.lastSent[key] = now
+		e.release(m)
+	}
+	e.resetDebounceTimer()
+}
+
+// resetDebounceTimer sets the timer for the earliest held message.
+func (e *Endpoint) resetDebounceTimer() {
+	d := &e.debounce
+	if d.stop != nil {
+		d.stop()
+		d.stop, d.wait = nil, nil
+	}
+	var due time.Time
+	for key := range d.pending {
+		t := d.lastSent[key].Add(e.info.MinInterval)
+		if due.IsZero() || t.Before(due) {
+			due = t
+		}
+	}
+	if !due.IsZero() {
+		d.wait, d.stop = e.info.timer(due.Sub(e.info.now()))
+	}
+}
@@ -0,0 +1,53 @@
+package nsca
+
+import (
+	"time"
+)
+
+// Diagnostics describes a test connection made by Diagnose.
+type Diagnostics struct {
+	// RemoteAddr is the address actually connected to, with host names resolved.
+	RemoteAddr string
+	// ConnectLatency is how long it took to establish the connection, including the TLS
+	// handshake if TLSConfig is set.
+	ConnectLatency time.Duration
+	// HandshakeLatency is how long it took to receive the initialization packet once
+	// connected.
+	HandshakeLatency time.Duration
+	// IVLength is the number of IV bytes the encryption method uses (see
+	// NSCAServer.CipherIVLen).
+	IVLength int
+	// ServerTimestamp is the timestamp from the server's initialization packet.
+	ServerTimestamp time.Time
+	// Cipher is the libmcrypt name of the encryption method, such as "rijndael-128".
+	Cipher string
+}
+
+// Diagnose connects to an NSCA server and completes the handshake without sending a
+// message, like Ping, and describes what it found. If a step fails, the error is
+// returned along with the diagnostics gathered before the failure. A successful handshake
+// does not prove that the password and encryption method match the daemon's, since the
+// daemon never answers a data packet.
+func Diagnose(connectInfo ServerInfo) (Diagnostics, error) {
+	d := Diagnostics{Cipher: encryptionNames[connectInfo.EncryptionMethod]}
+	ctx, cancel := overallContext(connectInfo)
+	defer cancel()
+	start := time.Now()
+	conn, err := dial(ctx, connectInfo)
+	if err != nil {
+		return d, err
+	}
+	d.ConnectLatency = time.Since(start)
+	d.RemoteAddr = conn.RemoteAddr().String()
+	server := new(NSCAServer)
+	defer server.Close()
+	start = time.Now()
+	err = server.handshake(conn, connectInfo)
+	if err != nil {
+		return d, err
+	}
+	d.HandshakeLatency = time.Since(start)
+	d.IVLength = server.CipherIVLen()
+	d.ServerTimestamp = time.Unix(int64(server.serverTimestamp), 0)
+	return d, nil
+}
@@ -0,0 +1,109 @@
+package nsca
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// DialFunc opens a connection to addr for a transport registered with RegisterTransport.
+type DialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+var (
+	transportsMu sync.RWMutex
+	transports   = make(map[string]DialFunc)
+)
+
+// RegisterTransport makes dial the way connections are opened when ServerInfo.Network is
+// name, so tests and unusual deployments can supply their own transport, such as an
+// in-memory pipe or a tunnel. addr is Host and Port joined as for "tcp". A registered
+// name takes precedence over the built-in networks of the same name; registering a nil
+// dial removes it again. It is safe to call at any time, but a transport usually
+// registers itself from an init function.
+func RegisterTransport(name string, dial DialFunc) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if dial == nil {
+		delete(transports, name)
+		return
+	}
+	transports[name] = dial
+}
+
+func registeredTransport(name string) DialFunc {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	return transports[name]
+}
+
+// dialNetwork opens the network connection to the server, through a registered transport
+// if there is one for Network, racing the host's addresses if ParallelDial is set.
+func dialNetwork(ctx context.Context, connectInfo ServerInfo) (net.Conn, error) {
+	network := connectInfo.network()
+	if dial := registeredTransport(network); dial != nil {
+		if connectInfo.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, connectInfo.Timeout)
+			defer cancel()
+		}
+		return dial(ctx, net.JoinHostPort(connectInfo.Host, connectInfo.Port))
+	}
+	dialer := net.Dialer{Timeout: connectInfo.Timeout}
+	if !connectInfo.ParallelDial || network == "unix" || connectInfo.Host == "" ||
+		net.ParseIP(connectInfo.Host) != nil {
+		return dialer.DialContext(ctx, network, connectInfo.address())
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, connectInfo.Host)
+	if err != nil {
+		return nil, err
+	}
+	var targets []string
+	for _, addr := range addrs {
+		is4 := addr.IP.To4() != nil
+		if (network == "tcp4" && !is4) || (network == "tcp6" && is4) {
+			continue
+		}
+		targets = append(targets, net.JoinHostPort(addr.String(), connectInfo.Port))
+	}
+	if len(targets) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: connectInfo.Host}
+	}
+	return raceDial(ctx, &dialer, network, targets)
+}
+
+// raceDial dials every address at once and returns the first connection established,
+// closing the others. If every dial fails, it returns all the errors.
+func raceDial(ctx context.Context, dialer *net.Dialer, network string, addresses []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addresses))
+	for _, address := range addresses {
+		go func(address string) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			results <- result{conn, err}
+		}(address)
+	}
+	var winner net.Conn
+	var errs []error
+	for range addresses {
+		r := <-results
+		switch {
+		case r.err != nil:
+			errs = append(errs, r.err)
+		case winner == nil:
+			winner = r.conn
+			cancel()
+		default:
+			r.conn.Close()
+		}
+	}
+	if winner != nil {
+		return winner, nil
+	}
+	return nil, errors.Join(errs...)
+}
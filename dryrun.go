@@ -0,0 +1,58 @@
+package nsca
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// dryRunConn stands in for the network connection in dry-run mode. Reads return a
+// synthetic initialization packet, and writes go to an optional sink.
+type dryRunConn struct {
+	init *bytes.Reader
+	sink io.Writer
+}
+
+func newDryRunConn(sink io.Writer) (*dryRunConn, error) {
+	iv := make([]byte, InitIVLength)
+	_, err := rand.Read(iv)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, iv)
+	binary.Write(buf, binary.BigEndian, uint32(time.Now().Unix()))
+	return &dryRunConn{init: bytes.NewReader(buf.Bytes()), sink: sink}, nil
+}
+
+// Read returns the initialization packet, then behaves like a connection on which the
+// server never sends anything else, timing out.
+func (c *dryRunConn) Read(b []byte) (int, error) {
+	if c.init.Len() == 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.init.Read(b)
+}
+
+func (c *dryRunConn) Write(b []byte) (int, error) {
+	if c.sink == nil {
+		return len(b), nil
+	}
+	return c.sink.Write(b)
+}
+
+func (c *dryRunConn) Close() error                       { return nil }
+func (c *dryRunConn) LocalAddr() net.Addr                { return dryRunAddr{} }
+func (c *dryRunConn) RemoteAddr() net.Addr               { return dryRunAddr{} }
+func (c *dryRunConn) SetDeadline(t time.Time) error      { return nil }
+func (c *dryRunConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dryRunConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type dryRunAddr struct{}
+
+func (dryRunAddr) Network() string { return "dryrun" }
+func (dryRunAddr) String() string  { return "dryrun" }
@@ -0,0 +1,122 @@
+package nsca
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Encoder turns messages into encrypted data packets for one session, without a network
+// connection. The encryption is set up once and reused for every packet, so an Encoder
+// is the cheap way to encode many messages with the same IV and timestamp. The output is
+// deterministic: where NSCAServer.Send, like send_nsca, fills the unused part of each
+// field with random bytes, an Encoder fills it with zeros, so the same message always
+// produces the same bytes. The daemon ignores those bytes either way.
+type Encoder struct {
+	server NSCAServer
+}
+
+// zeroReader is the padding source of an Encoder.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// NewEncoder creates an Encoder for the session a server would start by sending iv and
+// timestamp in its initialization packet. iv is zero padded or truncated to InitIVLength.
+// The encryption, output and verification settings of connectInfo apply as they do to
+// NSCAServer.Send; the connection settings are ignored.
+func NewEncoder(connectInfo ServerInfo, iv []byte, timestamp uint32) (*Encoder, error) {
+	connectInfo, err := connectInfo.readPasswordFile()
+	if err != nil {
+		return nil, err
+	}
+	if !IsEncryptionSupported(connectInfo.EncryptionMethod) {
+		return nil, fmt.Errorf("%w %d (%s)", ErrEncryptionUnsupported, connectInfo.EncryptionMethod,
+			encryptionNames[connectInfo.EncryptionMethod])
+	}
+	if connectInfo.EncryptionMethod != ENCRYPT_NONE && connectInfo.Password == "" {
+		return nil, ErrEmptyPassword
+	}
+	ip := &initializationPacket{iv: make([]byte, InitIVLength), timestamp: timestamp}
+	copy(ip.iv, iv)
+	e := new(Encoder)
+	err = e.server.setSession(connectInfo, ip)
+	if err != nil {
+		return nil, err
+	}
+	e.server.padding = zeroReader{}
+	return e, nil
+}
+
+// Encode returns the bytes NSCAServer.Send would write for m: one DataPacketSize packet,
+// or several with ServerInfo.AllowChunkedOutput.
+func (e *Encoder) Encode(m *Message) ([]byte, error) {
+	return e.server.encode(m)
+}
+
+// EncodePacket encodes a single message the way NewEncoder and Encoder.Encode do. Use an
+// Encoder to encode several messages for the same session.
+func EncodePacket(connectInfo ServerInfo, iv []byte, timestamp uint32, m *Message) ([]byte, error) {
+	e, err := NewEncoder(connectInfo, iv, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return e.Encode(m)
+}
+
+// EncodeBatchTo encodes messages the way EncodePacket does and writes their packets to w,
+// for example to archive a copy of what is sent. Pass the iv and timestamp of the
+// session being archived for the copy to match the bytes on the wire, padding aside. It
+// returns the number of messages written in full, stopping at the first message that
+// cannot be encoded or written.
+func EncodeBatchTo(w io.Writer, connectInfo ServerInfo, iv []byte, timestamp uint32, messages []*Message) (int, error) {
+	e, err := NewEncoder(connectInfo, iv, timestamp)
+	if err != nil {
+		return 0, err
+	}
+	for i, m := range messages {
+		b, err := e.Encode(m)
+		if err == nil {
+			err = writePacket(w, b)
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(messages), nil
+}
+
+// benchmarkCipherPackets is the number of packets BenchmarkCipher encodes.
+const benchmarkCipherPackets = 1000
+
+// BenchmarkCipher measures what method costs on this machine: it encodes and encrypts a
+// typical data packet a thousand times in memory with an Encoder, and returns
+// the average time per packet. The key is set up once beforehand, as it is once per
+// connection, so the result is the cost per message sent. Compare it across methods,
+// or multiply it by a packet rate to get the CPU time spent. It returns an error if the
+// method is not supported or needs a password and none is given.
+func BenchmarkCipher(method int, password string) (time.Duration, error) {
+	iv := make([]byte, InitIVLength)
+	for i := range iv {
+		iv[i] = byte(i)
+	}
+	e, err := NewEncoder(ServerInfo{EncryptionMethod: method, Password: password}, iv, uint32(time.Now().Unix()))
+	if err != nil {
+		return 0, err
+	}
+	m := &Message{State: STATE_OK, Host: "host.example.com", Service: "Benchmark",
+		Message: "OK - a typical plugin output line | time=0.012s;1;5;0"}
+	start := time.Now()
+	for i := 0; i < benchmarkCipherPackets; i++ {
+		_, err = e.Encode(m)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start) / benchmarkCipherPackets, nil
+}
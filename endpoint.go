@@ -0,0 +1,685 @@
+package nsca
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConnState describes a change in the state of an endpoint's connection.
+type ConnState int
+
+const (
+	// Connected is reported after a successful connection and handshake.
+	Connected ConnState = iota
+	// Disconnected is reported when an established connection is closed after an error.
+	Disconnected
+	// Reconnecting is reported when a new connection is attempted after a previous one.
+	Reconnecting
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Connected:
+		return "Connected"
+	case Disconnected:
+		return "Disconnected"
+	case Reconnecting:
+		return "Reconnecting"
+	}
+	return "Unknown"
+}
+
+// RunEndpoint creates a long-lived connection to an NSCA server. Messages sent into the messages
+// channel are sent to the NSCA server. Close the quit channel (or the messages channel) to end
+// the routine. RunEndpoint does it's own initialization, cleanup and error recovery and can
+// safely be used from multiple threads.
+func RunEndpoint(connectInfo ServerInfo, quit <-chan interface{}, messages <-chan *Message) {
+	NewEndpoint(connectInfo).Run(quit, messages)
+}
+
+// Endpoint is the long-lived connection behind RunEndpoint. Use it directly to change the
+// configuration of a running endpoint.
+type Endpoint struct {
+	info      ServerInfo
+	server    NSCAServer
+	connected bool          // set once the first connection succeeds
+	ready     chan struct{} // closed once the first connection succeeds
+	paused    chan struct{} // signalled by Pause to wake Run
+	readyOnce sync.Once
+	breaker   breaker
+	debounce  debouncer
+	lastUsed  time.Time // last successful connect or send
+	lastDial  time.Time // start of the last connection attempt
+	lastHost  time.Time // last successful send of a message for the heartbeat's host
+
+	mu        sync.Mutex
+	update    *ServerInfo    // applied before the next message
+	draining  bool           // set by Close
+	drainErr  error          // first error while draining
+	cancel    bool           // set by Cancel
+	cancelled int            // messages reported as ErrCancelled
+	inFlight  int            // taken from messages and not yet reported
+	dials     int            // connection attempts, handshake included
+	results   ShutdownReport // returned by Report
+	resumed   chan struct{}  // non-nil while paused, closed by Resume
+	stopping  bool           // set by stop, after which Pause does nothing
+
+	// set by StartEndpoint
+	queue      chan *Message
+	submitMu   sync.RWMutex // held for writing to close queue
+	stopped    bool
+	done       chan struct{}
+	checkpoint *queueCheckpoint // nil unless ServerInfo.PersistQueueDir is set
+	restored   []*Message       // loaded from the checkpoint, sent first by Run
+}
+
+// ErrQueueFull is returned by Endpoint.SubmitTimeout when the queue stayed full for the
+// whole timeout.
+var ErrQueueFull = errors.New("Endpoint queue is full")
+
+// ErrEndpointStopped is returned when a message is submitted to a stopped Endpoint.
+var ErrEndpointStopped = errors.New("Endpoint is stopped")
+
+// ShutdownReport summarizes what an endpoint did with the messages it was given.
+type ShutdownReport struct {
+	// Delivered is the number of messages sent successfully, heartbeats included.
+	Delivered int
+	// Dropped is the number of messages deliberately not sent: those superseded,
+	// debounced or cancelled, and those still waiting, without a result, when the
+	// endpoint stopped.
+	Dropped int
+	// Failed is the number of messages whose delivery failed.
+	Failed int
+	// LastError is the error of the most recent failure, or nil if there was none.
+	LastError error
+}
+
+// ErrCancelled is reported on the Status channel of a message that was still waiting to be
+// sent when Endpoint.Cancel was called.
+var ErrCancelled = errors.New("Message cancelled by endpoint shutdown")
+
+// ErrRetriesExhausted is reported, wrapping the last error, on the Status channel of a
+// message that was retried (see ServerInfo.MaxRetries and ShouldRetry) and still failed.
+var ErrRetriesExhausted = errors.New("Message dropped after exhausting its retries")
+
+// NewEndpoint creates an Endpoint. Call Run to start it.
+func NewEndpoint(connectInfo ServerInfo) *Endpoint {
+	return &Endpoint{info: connectInfo, ready: make(chan struct{}), paused: make(chan struct{}, 1)}
+}
+
+// StartEndpoint creates an Endpoint with an internal queue of up to queueSize messages and
+// runs it in its own goroutine. Add messages with Submit or SubmitTimeout, and call Close
+// to shut it down. With ServerInfo.PersistQueueDir, the messages left in its checkpoint
+// are sent before any submitted ones.
+func StartEndpoint(connectInfo ServerInfo, queueSize int) *Endpoint {
+	e := NewEndpoint(connectInfo)
+	e.queue = make(chan *Message, queueSize)
+	e.done = make(chan struct{})
+	stop := make(chan struct{})
+	if connectInfo.PersistQueueDir != "" {
+		e.checkpoint = newQueueCheckpoint(connectInfo.PersistQueueDir)
+		restored, err := e.checkpoint.load()
+		if err != nil {
+			connectInfo.logf("Could not restore NSCA queue checkpoint: %s", err)
+		} else if len(restored) > 0 {
+			connectInfo.logf("Restored %d queued messages from NSCA queue checkpoint", len(restored))
+		}
+		e.restored = restored
+		go e.checkpoint.run(connectInfo, stop)
+	}
+	go func() {
+		defer close(e.done)
+		e.Run(nil, e.queue)
+		if e.checkpoint != nil {
+			close(stop)
+			if err := e.checkpoint.write(); err != nil {
+				connectInfo.logf("Could not checkpoint NSCA queue: %s", err)
+			}
+		}
+	}()
+	return e
+}
+
+// Submit adds a message to the queue of an Endpoint created by StartEndpoint, waiting for
+// as long as it takes for space in the queue. The result of the delivery is reported on
+// the message's Status channel as usual.
+func (e *Endpoint) Submit(m *Message) error {
+	e.submitMu.RLock()
+	defer e.submitMu.RUnlock()
+	if e.stopped {
+		return ErrEndpointStopped
+	}
+	e.checkpoint.add(m)
+	e.queue <- m
+	return nil
+}
+
+// SubmitTimeout is like Submit, but gives up and returns ErrQueueFull if there is no space
+// in the queue within d. A d of zero never waits.
+func (e *Endpoint) SubmitTimeout(m *Message, d time.Duration) error {
+	e.submitMu.RLock()
+	defer e.submitMu.RUnlock()
+	if e.stopped {
+		return ErrEndpointStopped
+	}
+	e.checkpoint.add(m)
+	select {
+	case e.queue <- m:
+		return nil
+	default:
+	}
+	if d <= 0 {
+		e.checkpoint.remove(m)
+		return ErrQueueFull
+	}
+	e.mu.Lock()
+	info := e.info
+	e.mu.Unlock()
+	timeout, stop := info.timer(d)
+	defer stop()
+	select {
+	case e.queue <- m:
+		return nil
+	case <-timeout:
+		e.checkpoint.remove(m)
+		return ErrQueueFull
+	}
+}
+
+// Close shuts down an Endpoint created by StartEndpoint, implementing io.Closer. Messages
+// already in the queue are delivered first, resuming a paused endpoint, and Close returns
+// once they have been, with the first delivery error that occurred while draining, if
+// any. Later submissions return ErrEndpointStopped, and later calls to Close return nil.
+func (e *Endpoint) Close() error {
+	if !e.stop(false) {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.drainErr
+}
+
+// Cancel shuts down an Endpoint created by StartEndpoint without delivering the queue. A
+// message that is already being written is finished; every other message still waiting is
+// reported as ErrCancelled instead of being sent. Cancel returns once all of them have been
+// reported, with the number of messages cancelled. Like Close, later submissions return
+// ErrEndpointStopped, and later calls return 0.
+func (e *Endpoint) Cancel() int {
+	if !e.stop(true) {
+		return 0
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cancelled
+}
+
+// stop closes the queue and waits for Run to return. It returns false if the endpoint
+// was not started by StartEndpoint or was already stopped.
+func (e *Endpoint) stop(cancel bool) bool {
+	if e.queue == nil {
+		return false
+	}
+	// resume first: a submission blocked on the full queue of a paused endpoint holds
+	// submitMu until Run takes a message
+	e.mu.Lock()
+	e.stopping = true
+	e.mu.Unlock()
+	e.Resume()
+	e.submitMu.Lock()
+	if e.stopped {
+		e.submitMu.Unlock()
+		<-e.done
+		return false
+	}
+	e.stopped = true
+	e.mu.Lock()
+	e.draining = true
+	e.cancel = cancel
+	e.mu.Unlock()
+	close(e.queue)
+	e.submitMu.Unlock()
+	<-e.done
+	return true
+}
+
+// Pause stops the endpoint sending anything, heartbeats and keepalives included, without
+// closing it, for example during maintenance of the server. A send already under way
+// is finished. Messages keep queueing: Submit waits and SubmitTimeout gives up with
+// ErrQueueFull once the queue is full, and an endpoint started with Run does not read its
+// messages channel. Resume sends the backlog. Pause does nothing once Close or Cancel
+// has been called, and both resume a paused endpoint. Pause and Resume can be called
+// from any thread.
+func (e *Endpoint) Pause() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.resumed != nil || e.stopping {
+		return
+	}
+	e.resumed = make(chan struct{})
+	select {
+	case e.paused <- struct{}{}:
+	default:
+	}
+}
+
+// Resume lets a paused endpoint send again, starting with the messages that queued while
+// it was paused. It does nothing if the endpoint is not paused.
+func (e *Endpoint) Resume() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.resumed != nil {
+		close(e.resumed)
+		e.resumed = nil
+	}
+}
+
+// waitResumed blocks while the endpoint is paused. It returns false if quit was closed
+// first.
+func (e *Endpoint) waitResumed(quit <-chan interface{}) bool {
+	e.mu.Lock()
+	resumed := e.resumed
+	e.mu.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-quit:
+		return false
+	case <-resumed:
+		return true
+	}
+}
+
+// InFlight returns the number of messages given to the endpoint that have not had their
+// result reported yet: those waiting in the queue of an Endpoint created by StartEndpoint,
+// plus those taken from the messages channel and not yet sent or reported.
+func (e *Endpoint) InFlight() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.queue) + e.inFlight
+}
+
+// take records that n messages were taken from the messages channel.
+func (e *Endpoint) take(n int) {
+	e.mu.Lock()
+	e.inFlight += n
+	e.mu.Unlock()
+}
+
+// cancelling reports whether Cancel has been called.
+func (e *Endpoint) cancelling() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cancel
+}
+
+// Report returns the counts of what the endpoint has done with its messages so far. Once
+// Run has returned, or Close or Cancel for an Endpoint created by StartEndpoint, it is the
+// final summary, also passed to ServerInfo.OnShutdown.
+func (e *Endpoint) Report() ShutdownReport {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.results
+}
+
+// shutdown counts the messages left without a result as dropped and passes the final
+// report to info.OnShutdown.
+func (e *Endpoint) shutdown() {
+	e.mu.Lock()
+	e.results.Dropped += e.inFlight
+	e.inFlight = 0
+	report := e.results
+	e.mu.Unlock()
+	if e.info.OnShutdown != nil {
+		e.info.OnShutdown(report)
+	}
+}
+
+// Run sends messages to the NSCA server until quit or messages is closed, as described for
+// RunEndpoint. Run must only be called once.
+func (e *Endpoint) Run(quit <-chan interface{}, messages <-chan *Message) {
+	defer e.shutdown()
+	defer e.disconnect()
+	if e.info.EagerConnect && e.info.Transport == NSCA {
+		err := e.connect()
+		if err != nil {
+			e.info.logf("Initial connection to NSCA server failed: %s", err)
+		} else {
+			e.info.logf("Connected to NSCA server %s", e.server.conn.RemoteAddr())
+		}
+	}
+	defer e.finalHeartbeat()
+	defer e.flushDebounced(true)
+	for _, m := range e.restored {
+		if !e.waitResumed(quit) {
+			return
+		}
+		e.take(1)
+		e.applyUpdate()
+		e.deliver(m)
+	}
+	e.restored = nil
+	if e.info.PriorityQueue {
+		e.runPriority(quit, messages)
+		return
+	}
+	heartbeat, stop := e.heartbeatTicker()
+	defer stop()
+	keepalive, stopKeepalive := e.keepaliveTicker()
+	defer stopKeepalive()
+	for {
+		if !e.waitResumed(quit) {
+			return
+		}
+		select {
+		case <-quit:
+			return
+		case <-e.paused:
+		case <-heartbeat:
+			e.applyUpdate()
+			e.sendHeartbeat("")
+		case <-keepalive:
+			e.applyUpdate()
+			e.sendKeepalive()
+		case <-e.debounce.wait:
+			e.applyUpdate()
+			e.flushDebounced(false)
+		case m, ok := <-messages:
+			if !ok {
+				return
+			}
+			e.take(1)
+			e.applyUpdate()
+			if !e.info.CoalesceByService {
+				e.deliver(m)
+				continue
+			}
+			backlog, open := drain(m, messages)
+			e.take(len(backlog) - 1)
+			e.deliverCoalesced(backlog)
+			if !open {
+				return
+			}
+		}
+	}
+}
+
+// UpdateConfig replaces the endpoint's configuration, for example to rotate the password.
+// The current connection is closed before the next message is sent, and the endpoint
+// reconnects with the new settings. Messages already queued are not lost. UpdateConfig
+// can be called from any thread.
+func (e *Endpoint) UpdateConfig(connectInfo ServerInfo) error {
+	if !IsEncryptionSupported(connectInfo.EncryptionMethod) {
+		return fmt.Errorf("%w %d (%s)", ErrEncryptionUnsupported, connectInfo.EncryptionMethod,
+			encryptionNames[connectInfo.EncryptionMethod])
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.update = &connectInfo
+	return nil
+}
+
+func (e *Endpoint) applyUpdate() {
+	e.mu.Lock()
+	update := e.update
+	e.update = nil
+	e.mu.Unlock()
+	if update != nil {
+		e.disconnect()
+		// under mu for SubmitTimeout, which reads the timer hook from other threads
+		e.mu.Lock()
+		e.info = *update
+		e.mu.Unlock()
+	}
+}
+
+// ErrSuperseded is reported on the Status channel of a message that was not sent because
+// a newer message for the same host and service replaced it (see ServerInfo.CoalesceByService).
+var ErrSuperseded = errors.New("Message superseded by a newer message for the same service")
+
+// drain returns m followed by every message already waiting in messages, and whether
+// messages is still open.
+func drain(m *Message, messages <-chan *Message) ([]*Message, bool) {
+	backlog := []*Message{m}
+	for {
+		select {
+		case m, ok := <-messages:
+			if !ok {
+				return backlog, false
+			}
+			backlog = append(backlog, m)
+		default:
+			return backlog, true
+		}
+	}
+}
+
+// deliverCoalesced sends the newest message for each host and service in backlog and
+// reports ErrSuperseded for the rest.
+func (e *Endpoint) deliverCoalesced(backlog []*Message) {
+	latest := make(map[CheckTarget]int)
+	for i, m := range backlog {
+		latest[m.Target()] = i
+	}
+	for i, m := range backlog {
+		if latest[m.Target()] != i {
+			e.report(m, ErrSuperseded)
+			continue
+		}
+		e.deliver(m)
+	}
+}
+
+// Handshakes returns the number of connections, each with its NSCA handshake, that the
+// endpoint has attempted, successful or not. A count that climbs quickly points at a
+// flapping server; see ServerInfo.MinReconnectInterval.
+func (e *Endpoint) Handshakes() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.dials
+}
+
+func (e *Endpoint) connect() error {
+	if e.connected {
+		e.notify(Reconnecting)
+	}
+	if e.info.MinReconnectInterval > 0 && !e.lastDial.IsZero() {
+		if wait := e.info.MinReconnectInterval - e.info.now().Sub(e.lastDial); wait > 0 {
+			e.info.logf("Reconnecting to NSCA server too soon, waiting %s", wait)
+			e.info.sleep(wait)
+		}
+	}
+	e.lastDial = e.info.now()
+	e.mu.Lock()
+	e.dials++
+	e.mu.Unlock()
+	err := e.server.Connect(e.info)
+	if err != nil {
+		return err
+	}
+	e.connected = true
+	e.lastUsed = e.info.now()
+	e.markReady()
+	e.notify(Connected)
+	return nil
+}
+
+// markReady releases the callers of WaitReady.
+func (e *Endpoint) markReady() {
+	e.readyOnce.Do(func() { close(e.ready) })
+}
+
+// WaitReady waits until the endpoint has completed its first successful handshake, so a
+// readiness check can report whether delivery is actually possible, and returns nil; or
+// until ctx ends, returning its error. It returns immediately once the endpoint has been
+// connected, even if that connection has since been lost. Without EagerConnect, the
+// first connection is only made for the first message. With the NRDP transport, which
+// has no handshake, the endpoint is ready after its first successful send.
+func (e *Endpoint) WaitReady(ctx context.Context) error {
+	select {
+	case <-e.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *Endpoint) disconnect() {
+	if e.server.conn != nil {
+		e.server.Close()
+		e.notify(Disconnected)
+	}
+}
+
+// notify reports a connection state change to info.StateChanges without blocking.
+func (e *Endpoint) notify(state ConnState) {
+	if e.info.StateChanges == nil {
+		return
+	}
+	select {
+	case e.info.StateChanges <- state:
+	default:
+	}
+}
+
+// deliver sends a queued message, unless it is held back by ServerInfo.MinInterval.
+func (e *Endpoint) deliver(m *Message) {
+	if e.info.MinInterval > 0 && !e.cancelling() && !e.admit(m) {
+		return
+	}
+	e.release(m)
+}
+
+// release sends a queued message, or reports ErrCancelled if Cancel has been called.
+func (e *Endpoint) release(m *Message) {
+	if e.cancelling() {
+		e.report(m, ErrCancelled)
+		return
+	}
+	err := e.send(m)
+	if err == nil && e.info.Heartbeat != nil && m.Host == e.info.Heartbeat.Host {
+		e.lastHost = e.info.now()
+	}
+}
+
+// send sends a message, connecting first if needed, reports the result and returns it.
+func (e *Endpoint) send(m *Message) error {
+	if !e.breaker.allow(e.info) {
+		e.report(m, ErrBreakerOpen)
+		return ErrBreakerOpen
+	}
+	if e.server.conn != nil && e.info.IdleTimeout > 0 && e.info.now().Sub(e.lastUsed) > e.info.IdleTimeout {
+		e.info.logf("NSCA connection idle for longer than %s, reconnecting", e.info.IdleTimeout)
+		e.disconnect()
+	}
+	err := e.attempt(m)
+	attempts := 1
+	for err != nil && e.shouldRetry(err, attempts) {
+		e.info.logf("Sending to NSCA server failed, retrying (retry %d): %s", attempts, err)
+		e.disconnect()
+		err = e.attempt(m)
+		attempts++
+	}
+	if err != nil && attempts > 1 {
+		err = fmt.Errorf("%w after %d attempts: %w", ErrRetriesExhausted, attempts, err)
+	}
+	if err == nil {
+		e.lastUsed = e.info.now()
+	}
+	e.breaker.record(e.info, err)
+	e.report(m, err)
+	if err != nil {
+		e.disconnect()
+	}
+	return err
+}
+
+// shouldRetry reports whether to make retry number retry of a message that failed with
+// err, as described for ServerInfo.ShouldRetry.
+func (e *Endpoint) shouldRetry(err error, retry int) bool {
+	if e.info.MaxRetries > 0 && retry > e.info.MaxRetries {
+		return false
+	}
+	if e.info.ShouldRetry != nil {
+		return e.info.ShouldRetry(err, retry)
+	}
+	return e.info.MaxRetries > 0 && DefaultShouldRetry(err, retry)
+}
+
+// DefaultShouldRetry is the retry policy used with ServerInfo.MaxRetries when ShouldRetry
+// is not set. It retries every error except those that would fail the same way on every
+// attempt: configuration errors (ErrEmptyPassword, ErrEncryptionUnsupported,
+// ErrEncryptionSetup, ErrInsecureConfig), messages that cannot be encoded (ErrInvalidUTF8)
+// and packets that fail VerifyOutgoing (ErrCRCMismatch). ShouldRetry implementations can
+// call it for the errors they do not handle themselves.
+func DefaultShouldRetry(err error, retry int) bool {
+	for _, permanent := range []error{ErrEmptyPassword, ErrEncryptionUnsupported, ErrEncryptionSetup,
+		ErrInsecureConfig, ErrInvalidUTF8, ErrCRCMismatch} {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+	return true
+}
+
+// attempt makes one attempt at sending a message, connecting first if needed.
+func (e *Endpoint) attempt(m *Message) error {
+	if e.info.Transport == NRDP {
+		err := sendNRDP(context.Background(), e.info, m)
+		if err == nil {
+			e.markReady()
+		}
+		return err
+	}
+	var err error
+	reused := e.server.conn != nil
+	if !reused {
+		err = e.connect()
+	}
+	if err == nil {
+		err = e.server.Send(m)
+	}
+	if reused && errors.Is(err, ErrConnectionClosed) {
+		// The server closed the idle connection, which is normal after a restart or
+		// in single-use mode. Earlier messages were already accepted; this one was
+		// not written, so reconnect and try it again.
+		e.info.logf("NSCA server closed the connection, reconnecting: %s", err)
+		e.disconnect()
+		err = e.connect()
+		if err == nil {
+			err = e.server.Send(m)
+		}
+	}
+	return err
+}
+
+// report sends the result of a message to its Status channel and info.OnResult.
+func (e *Endpoint) report(m *Message, err error) {
+	e.mu.Lock()
+	e.inFlight--
+	if err == ErrCancelled {
+		e.cancelled++
+	} else if err != nil && e.draining && e.drainErr == nil {
+		e.drainErr = err
+	}
+	switch err {
+	case nil:
+		e.results.Delivered++
+	case ErrCancelled, ErrSuperseded, ErrDebounced:
+		e.results.Dropped++
+	default:
+		e.results.Failed++
+		e.results.LastError = err
+	}
+	e.mu.Unlock()
+	e.checkpoint.remove(m)
+	if m.Status != nil {
+		m.Status <- err
+	}
+	if e.info.OnResult != nil {
+		e.info.OnResult(m, err)
+	}
+}
@@ -0,0 +1,72 @@
+package nsca
+
+import (
+	"time"
+)
+
+// finalHeartbeatOutput is the plugin output of the heartbeat sent on shutdown.
+const finalHeartbeatOutput = "Shut down cleanly"
+
+// heartbeatTicker returns a channel that fires every HeartbeatInterval, or nil if
+// heartbeats are disabled, and a function to stop it.
+func (e *Endpoint) heartbeatTicker() (<-chan time.Time, func()) {
+	if e.info.Heartbeat == nil || e.info.HeartbeatInterval <= 0 {
+		return nil, func() {}
+	}
+	return e.info.ticker(e.info.HeartbeatInterval)
+}
+
+// sendHeartbeat sends a copy of the heartbeat template, even after Cancel. If output is
+// not empty, it replaces the template's plugin output. With CoalesceHeartbeat, a periodic
+// heartbeat is skipped if real traffic for its host was sent within the interval.
+func (e *Endpoint) sendHeartbeat(output string) {
+	if output == "" && e.info.CoalesceHeartbeat && !e.lastHost.IsZero() &&
+		e.info.now().Sub(e.lastHost) < e.info.HeartbeatInterval {
+		return
+	}
+	m := *e.info.Heartbeat
+	m.Status = nil
+	if output != "" {
+		m.Message = output
+	}
+	e.take(1)
+	e.send(&m)
+}
+
+// finalHeartbeat sends the shutdown heartbeat if it is enabled.
+func (e *Endpoint) finalHeartbeat() {
+	if e.info.Heartbeat != nil && e.info.FinalHeartbeat {
+		e.sendHeartbeat(finalHeartbeatOutput)
+	}
+}
+
+// keepaliveMessage returns the AppKeepalive template, or nil if there is none.
+func (e *Endpoint) keepaliveMessage() *Message {
+	if e.info.AppKeepaliveMessage != nil {
+		return e.info.AppKeepaliveMessage
+	}
+	return e.info.Heartbeat
+}
+
+// keepaliveTicker returns a channel that fires every half AppKeepalive, or nil if
+// keepalives are disabled, and a function to stop it. Checking twice per interval keeps
+// the connection from going more than AppKeepalive without traffic.
+func (e *Endpoint) keepaliveTicker() (<-chan time.Time, func()) {
+	if e.info.AppKeepalive <= 0 || e.keepaliveMessage() == nil {
+		return nil, func() {}
+	}
+	return e.info.ticker(e.info.AppKeepalive / 2)
+}
+
+// sendKeepalive sends a copy of the keepalive template if the connection is open and has
+// been idle for half AppKeepalive or more.
+func (e *Endpoint) sendKeepalive() {
+	m := e.keepaliveMessage()
+	if m == nil || e.server.conn == nil || e.info.now().Sub(e.lastUsed) < e.info.AppKeepalive/2 {
+		return
+	}
+	keepalive := *m
+	keepalive.Status = nil
+	e.take(1)
+	e.send(&keepalive)
+}
@@ -0,0 +1,41 @@
+package nsca
+
+// StaleMarker starts the plugin output of results created by NewStaleMarker. Check
+// processors that understand the convention can match on it to put the service into a
+// stale or pending state; anything else sees an ordinary UNKNOWN result.
+const StaleMarker = "[STALE]"
+
+// NewStaleMarker returns a message that marks a passive service as stale: an UNKNOWN
+// result whose plugin output is StaleMarker followed by a short explanation. Use it
+// (rather than formatting the output by hand) so every producer emits the marker the
+// same way.
+func NewStaleMarker(host, service string) *Message {
+	return &Message{
+		State:   STATE_UNKNOWN,
+		Host:    host,
+		Service: service,
+		Message: StaleMarker + " No current result, marked stale by the submitter",
+	}
+}
+
+// NoDataMarker starts the plugin output of results created by NewNoDataResult. It tells
+// processors that understand the convention that the check has no result yet and should
+// simply be rescheduled, as opposed to having failed. Vanilla Nagios does not know the
+// convention and treats the result as an ordinary UNKNOWN, notifications included.
+const NoDataMarker = "[NODATA]"
+
+// NewNoDataResult returns a message that reports "no result right now, reschedule" for a
+// passive service: an UNKNOWN result whose plugin output is NoDataMarker followed by
+// reason, or a default explanation if reason is empty. The classic NSCA protocol has no
+// field for such a flag, so the marker in the output is all that is sent.
+func NewNoDataResult(host, service, reason string) *Message {
+	if reason == "" {
+		reason = "No data available yet, reschedule"
+	}
+	return &Message{
+		State:   STATE_UNKNOWN,
+		Host:    host,
+		Service: service,
+		Message: NoDataMarker + " " + reason,
+	}
+}
@@ -0,0 +1,33 @@
+package nsca
+
+import (
+	"testing"
+)
+
+func TestNewStaleMarker(t *testing.T) {
+	m := NewStaleMarker("host", "service")
+	want := Message{
+		State:   STATE_UNKNOWN,
+		Host:    "host",
+		Service: "service",
+		Message: "[STALE] No current result, marked stale by the submitter",
+	}
+	if *m != want {
+		t.Errorf("Bad stale marker: %+v", m)
+	}
+}
+
+func TestNewNoDataResult(t *testing.T) {
+	for _, test := range []struct {
+		reason, output string
+	}{
+		{"", "[NODATA] No data available yet, reschedule"},
+		{"Collector starting", "[NODATA] Collector starting"},
+	} {
+		m := NewNoDataResult("host", "service", test.reason)
+		want := Message{State: STATE_UNKNOWN, Host: "host", Service: "service", Message: test.output}
+		if *m != want {
+			t.Errorf("Reason %q: bad no-data result: %+v", test.reason, m)
+		}
+	}
+}
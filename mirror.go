@@ -0,0 +1,100 @@
+package nsca
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Mirror delivers every message to several NSCA servers, such as independent Nagios
+// instances kept for redundancy. Each server has its own connection, made lazily and
+// re-made after errors. A Mirror is safe to use from multiple threads.
+type Mirror struct {
+	targets []*mirrorTarget
+}
+
+type mirrorTarget struct {
+	info   ServerInfo
+	mu     sync.Mutex
+	server NSCAServer
+}
+
+// MirrorFailure describes a failed delivery to one of a Mirror's servers.
+type MirrorFailure struct {
+	// Index is the position of the server in the list passed to NewMirror.
+	Index int
+	// Server is the address of the server.
+	Server string
+	// Err is the delivery error.
+	Err error
+}
+
+// MirrorError is returned by Mirror.Send when delivery to one or more servers failed.
+type MirrorError struct {
+	// Failures lists the servers that failed, in the order passed to NewMirror.
+	Failures []MirrorFailure
+	// Total is the number of servers in the Mirror.
+	Total int
+}
+
+func (e *MirrorError) Error() string {
+	var failures []string
+	for _, f := range e.Failures {
+		failures = append(failures, fmt.Sprintf("%s: %s", f.Server, f.Err))
+	}
+	return fmt.Sprintf("%d of %d mirrors failed: %s", len(e.Failures), e.Total, strings.Join(failures, "; "))
+}
+
+// Unwrap returns the individual delivery errors.
+func (e *MirrorError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+// NewMirror creates a Mirror that delivers to each of servers.
+func NewMirror(servers ...ServerInfo) *Mirror {
+	m := &Mirror{targets: make([]*mirrorTarget, len(servers))}
+	for i, info := range servers {
+		m.targets[i] = &mirrorTarget{info: info}
+	}
+	return m
+}
+
+// Send delivers a message to every server in parallel. It returns nil if all deliveries
+// succeeded, and a *MirrorError otherwise. The Status channel of the message is not used.
+func (m *Mirror) Send(message *Message) error {
+	errs := make([]error, len(m.targets))
+	var wg sync.WaitGroup
+	for i, t := range m.targets {
+		wg.Add(1)
+		go func(i int, t *mirrorTarget) {
+			defer wg.Done()
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			errs[i] = t.server.sendReconnecting(t.info, message)
+		}(i, t)
+	}
+	wg.Wait()
+	var failures []MirrorFailure
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, MirrorFailure{Index: i, Server: m.targets[i].info.address(), Err: err})
+		}
+	}
+	if failures != nil {
+		return &MirrorError{Failures: failures, Total: len(m.targets)}
+	}
+	return nil
+}
+
+// Close closes the connection to every server.
+func (m *Mirror) Close() {
+	for _, t := range m.targets {
+		t.mu.Lock()
+		t.server.Close()
+		t.mu.Unlock()
+	}
+}
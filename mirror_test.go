@@ -0,0 +1,30 @@
+package nsca
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	path1, received1 := unixServer(t)
+	path2, received2 := unixServer(t)
+	m := NewMirror(
+		ServerInfo{Network: "unix", Host: path1},
+		ServerInfo{Network: "unix", Host: path2},
+		ServerInfo{Network: "unix", Host: t.TempDir() + "/missing.sock"},
+	)
+	err := m.Send(&Message{State: STATE_OK, Host: "host", Message: "mirrored"})
+	var mirrorErr *MirrorError
+	if !errors.As(err, &mirrorErr) {
+		t.Fatalf("Expected a MirrorError, got %v", err)
+	}
+	if mirrorErr.Total != 3 || len(mirrorErr.Failures) != 1 || mirrorErr.Failures[0].Index != 2 {
+		t.Errorf("Bad MirrorError: %+v", mirrorErr)
+	}
+	m.Close()
+	for i, received := range []<-chan []byte{received1, received2} {
+		if b := <-received; len(b) != 720 {
+			t.Errorf("Mirror %d received %d bytes, expected 720", i, len(b))
+		}
+	}
+}
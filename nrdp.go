@@ -0,0 +1,165 @@
+package nsca
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Transport selects the protocol used to submit results.
+type Transport int
+
+const (
+	// NSCA submits results to an NSCA daemon. It is the default.
+	NSCA Transport = iota
+	// NRDP submits results to an NRDP (Nagios Remote Data Processor) HTTP endpoint. Host
+	// is the URL of the endpoint (for example "https://nagios.example.com/nrdp/") and
+	// Password is its token. TLSConfig, if set, is used for https URLs, and Timeout
+	// bounds each request. The other connection settings are ignored. NRDP is supported
+	// by the package level Send, Endpoint (RunEndpoint, StartEndpoint and SidecarServer),
+	// NSCAPool, Mirror and ReplaySpool, each submitting one HTTP request per message. It
+	// has no connection to hold open, so NSCAServer and SafeServer, and Ping, return
+	// ErrNRDPConnection for it.
+	NRDP
+)
+
+func (t Transport) String() string {
+	switch t {
+	case NSCA:
+		return "NSCA"
+	case NRDP:
+		return "NRDP"
+	}
+	return "Unknown"
+}
+
+// ErrNRDPConnection is returned by the calls that open an NSCA connection when
+// ServerInfo.Transport is NRDP.
+var ErrNRDPConnection = errors.New("The NRDP transport has no connection to open")
+
+// ErrNRDPRejected is returned, wrapped with the server's message, when an NRDP endpoint
+// answers a submission with a non-zero status.
+var ErrNRDPRejected = errors.New("NRDP submission rejected")
+
+type nrdpCheckResults struct {
+	XMLName xml.Name          `xml:"checkresults"`
+	Results []nrdpCheckResult `xml:"checkresult"`
+}
+
+type nrdpCheckResult struct {
+	Type      string `xml:"type,attr"`
+	CheckType int    `xml:"checktype,attr"`
+	Host      string `xml:"hostname"`
+	Service   string `xml:"servicename,omitempty"`
+	State     int16  `xml:"state"`
+	Output    string `xml:"output"`
+}
+
+type nrdpResult struct {
+	Status  int    `xml:"status"`
+	Message string `xml:"message"`
+}
+
+// nrdpPayload returns the XMLDATA document submitting messages as passive check results.
+// A message without a Service is a host check result.
+func nrdpPayload(connectInfo ServerInfo, messages ...*Message) ([]byte, error) {
+	var results nrdpCheckResults
+	for _, m := range messages {
+		output, err := pluginOutput(m, connectInfo.SanitizeOutput, connectInfo.ReplaceInvalidUTF8)
+		if err != nil {
+			return nil, err
+		}
+		if connectInfo.MaxOutputBytes > 0 {
+			output = truncateOutput(output, connectInfo.TruncationMarker, connectInfo.MaxOutputBytes)
+		}
+		host, service := rewriteTarget(m, connectInfo.HostRewriter, connectInfo.ServiceRewriter)
+		r := nrdpCheckResult{
+			Type:      "service",
+			CheckType: 1, // passive
+			Host:      host,
+			Service:   service,
+			State:     m.State,
+			Output:    output,
+		}
+		if service == "" {
+			r.Type = "host"
+		}
+		results.Results = append(results.Results, r)
+	}
+	b, err := xml.Marshal(results)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// nrdpTransports holds the transport for each ServerInfo.TLSConfig used with NRDP, so
+// that its keep-alive connections are reused, and closed when idle, rather than leaked
+// by a new transport for every request.
+var nrdpTransports sync.Map // *tls.Config to *http.Transport
+
+// nrdpTransport returns the transport for requests made with config: the default one
+// without a config, otherwise a copy of it using config, made on first use.
+func nrdpTransport(config *tls.Config) http.RoundTripper {
+	if config == nil {
+		return http.DefaultTransport
+	}
+	if t, ok := nrdpTransports.Load(config); ok {
+		return t.(*http.Transport)
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = config
+	actual, _ := nrdpTransports.LoadOrStore(config, t)
+	return actual.(*http.Transport)
+}
+
+// sendNRDP submits messages to the NRDP endpoint described by connectInfo.
+func sendNRDP(ctx context.Context, connectInfo ServerInfo, messages ...*Message) error {
+	connectInfo, err := connectInfo.readPasswordFile()
+	if err != nil {
+		return err
+	}
+	payload, err := nrdpPayload(connectInfo, messages...)
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"token":   {connectInfo.Password},
+		"cmd":     {"submitcheck"},
+		"XMLDATA": {string(payload)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, connectInfo.Host, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := &http.Client{Timeout: connectInfo.Timeout, Transport: nrdpTransport(connectInfo.TLSConfig)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("NRDP endpoint %s returned %s", connectInfo.Host, resp.Status)
+	}
+	var result nrdpResult
+	err = xml.Unmarshal(body, &result)
+	if err != nil {
+		return fmt.Errorf("Bad response from NRDP endpoint %s: %w", connectInfo.Host, err)
+	}
+	if result.Status != 0 {
+		return fmt.Errorf("%w: %s", ErrNRDPRejected, result.Message)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package nsca
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNRDP(t *testing.T) {
+	submitted := make(chan nrdpCheckResults, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("token") != "token" || r.FormValue("cmd") != "submitcheck" {
+			w.Write([]byte("<result><status>-1</status><message>BAD TOKEN</message></result>"))
+			return
+		}
+		var results nrdpCheckResults
+		if err := xml.Unmarshal([]byte(r.FormValue("XMLDATA")), &results); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		submitted <- results
+		w.Write([]byte("<result><status>0</status><message>OK</message></result>"))
+	}))
+	defer ts.Close()
+	info := ServerInfo{Transport: NRDP, Host: ts.URL, Password: "token"}
+
+	err := Send(info, &Message{State: STATE_WARNING, Host: "host", Service: "service", Message: "output"})
+	if err != nil {
+		t.Fatalf("Error sending: %s", err)
+	}
+	r := (<-submitted).Results
+	if len(r) != 1 || r[0].Type != "service" || r[0].CheckType != 1 || r[0].Host != "host" ||
+		r[0].Service != "service" || r[0].State != STATE_WARNING || r[0].Output != "output" {
+		t.Errorf("Bad check result: %+v", r)
+	}
+
+	// the endpoint uses the same transport; a message without a service is a host result
+	messages := make(chan *Message, 1)
+	status := make(chan error, 1)
+	messages <- &Message{State: STATE_CRITICAL, Host: "host", Message: "down", Status: status}
+	close(messages)
+	RunEndpoint(info, nil, messages)
+	if err := <-status; err != nil {
+		t.Fatalf("Error sending through the endpoint: %s", err)
+	}
+	r = (<-submitted).Results
+	if len(r) != 1 || r[0].Type != "host" || r[0].Service != "" || r[0].State != STATE_CRITICAL {
+		t.Errorf("Bad host check result: %+v", r)
+	}
+
+	// so do the pool, mirrors and spool replay
+	pool := NewPool(PoolConfig{Server: info})
+	if err := pool.Send(&Message{Host: "pool"}); err != nil {
+		t.Errorf("Error sending through the pool: %s", err)
+	} else if r = (<-submitted).Results; len(r) != 1 || r[0].Host != "pool" {
+		t.Errorf("Bad pool check result: %+v", r)
+	}
+	pool.Close()
+	mirror := NewMirror(info)
+	if err := mirror.Send(&Message{Host: "mirror"}); err != nil {
+		t.Errorf("Error sending through the mirror: %s", err)
+	} else if r = (<-submitted).Results; len(r) != 1 || r[0].Host != "mirror" {
+		t.Errorf("Bad mirror check result: %+v", r)
+	}
+	mirror.Close()
+	dir := t.TempDir()
+	w, err := NewSpoolWriter(dir)
+	if err != nil {
+		t.Fatalf("Error creating spool: %s", err)
+	}
+	if err := w.Write(&Message{Host: "spool"}); err != nil {
+		t.Fatalf("Error spooling: %s", err)
+	}
+	if err := ReplaySpool(info, dir); err != nil {
+		t.Errorf("Error replaying the spool: %s", err)
+	} else if r = (<-submitted).Results; len(r) != 1 || r[0].Host != "spool" {
+		t.Errorf("Bad spool check result: %+v", r)
+	}
+	if err := new(NSCAServer).Connect(info); !errors.Is(err, ErrNRDPConnection) {
+		t.Errorf("Expected ErrNRDPConnection, got %v", err)
+	}
+
+	// requests with the same TLS settings share a transport
+	config := &tls.Config{}
+	if nrdpTransport(config) != nrdpTransport(config) || nrdpTransport(nil) != http.DefaultTransport {
+		t.Errorf("Expected NRDP transports to be reused")
+	}
+
+	info.Password = "wrong"
+	err = Send(info, &Message{Host: "host"})
+	if !errors.Is(err, ErrNRDPRejected) {
+		t.Errorf("Expected ErrNRDPRejected, got %v", err)
+	}
+}
@@ -2,65 +2,524 @@
 package nsca
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net"
+	"os"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 // ServerInfo contains the configuration information for an NSCA server
 type ServerInfo struct {
+	// Transport selects the protocol, NSCA (the default) or NRDP.
+	Transport Transport
+	// Network is "tcp" (the default), "tcp4", "tcp6", "unix" or the name of a transport
+	// added with RegisterTransport.
+	Network string
 	// Host is the IP address or host name of the NSCA server. Leave empty for localhost.
+	// For the "unix" network, Host is the path of the socket.
 	Host string
-	// Port is the IP port number (no default)
+	// Port is the IP port number (no default). It is ignored for the "unix" network.
 	Port string
 	// EncryptionMethod specifies the message encryption to use on NSCA messages. It defaults to ENCRYPT_NONE.
 	EncryptionMethod int
-	// Password is used in encryption.
+	// Password is used in encryption. It is required by every method except ENCRYPT_NONE.
 	Password string
+	// PasswordFile, if set, is the path of a file holding the password, such as a mounted
+	// Kubernetes secret. It is read every time a connection is made, so a rotated secret
+	// is picked up on the next reconnect, and it takes precedence over Password. A single
+	// trailing newline is removed.
+	PasswordFile string
+	// KeyDeriver, if set, replaces DefaultKeyDeriver in turning Password into a cipher key of
+	// keyLen bytes, for daemons built against a libmcrypt that derives keys differently.
+	KeyDeriver func(password string, keyLen int) []byte
+	// BlockMode is the mode of operation for the DES, 3DES and RIJNDAEL methods. The
+	// default is BlockModeCFB8, libmcrypt's "cfb", which the reference daemon uses; a
+	// daemon using another mode cannot decrypt the packets even though the method and
+	// password are right.
+	BlockMode BlockMode
+	// HMACKey, if set, appends to every data packet an HMAC-SHA256, keyed with HMACKey, of
+	// the packet's cleartext (with its CRC32 filled in), so a receiver that shares the key
+	// can detect a tampered result. This is not part of NSCA: the HMACSize bytes follow
+	// each packet on the wire, unencrypted, and the standard daemon reads them as the
+	// start of the next packet and drops everything after the first. Only set it when
+	// the receiver is built to read and check them.
+	HMACKey []byte
+	// CRC, if set, replaces the standard NSCA CRC32 (crc32.ChecksumIEEE) in computing the
+	// checksum of each data packet, for a daemon built to use a different CRC. It is
+	// given the packet's cleartext with the CRC field zeroed, as the daemon checks it.
+	CRC func([]byte) uint32
 	// Timeout is the connect/read/write network timeout
 	Timeout time.Duration
+	// OverallTimeout bounds an entire call to the package level Send and Ping functions,
+	// including the dial, the handshake and the write. Timeout still applies to each step.
+	// An error caused by running out of time wraps context.DeadlineExceeded, so it can be
+	// told apart from a network failure.
+	OverallTimeout time.Duration
+	// TLSConfig, if set, wraps the connection in TLS, as used when the daemon is behind a
+	// TLS terminating proxy such as stunnel. Set Certificates (or GetClientCertificate) for
+	// servers that require client certificates. If ServerName is empty, Host is used.
+	TLSConfig *tls.Config
+	// ParallelDial, when Host is a name that resolves to several addresses, dials all of
+	// them at once and uses whichever connection is established first, instead of trying
+	// them one after another. This avoids waiting for Timeout on each address that is
+	// down, at the cost of briefly opening connections to several servers; the ones that
+	// lose the race are closed before the handshake.
+	ParallelDial bool
+	// TOS is the IP type-of-service byte (the DSCP value shifted left by two) to set on the
+	// connection. Zero leaves the system default in place.
+	TOS int
+	// MaxBatchSize limits how many messages SendBatch and SendStream write within a single
+	// Timeout window. Every MaxBatchSize messages the buffered packets are flushed and the
+	// deadline is reset. Zero resets the deadline for every message.
+	MaxBatchSize int
+	// MaxConcurrentSends limits how many sends an NSCAPool runs at once, regardless of its
+	// Size; callers beyond the limit wait their turn. It only has an effect when it is
+	// smaller than the pool, which then keeps its extra connections open but idle. The
+	// limit applies to whole sends, reconnects included, and is independent of MinInterval,
+	// which only RunEndpoint applies. Zero allows one send per pooled connection.
+	MaxConcurrentSends int
+	// UseClientTimestamp puts the client's current time (see Clock) in each packet instead
+	// of the timestamp from the server's initialization packet, for processors that expect
+	// the time the result was produced. The daemon's max_packet_age check then compares
+	// the server's clock with the client's, so any skew between the two counts towards
+	// the packet's age: a client clock running more than max_packet_age behind the
+	// server's gets every packet dropped. Only use it where clocks are synchronized.
+	// The packet timestamp is a whole number of seconds, so sub-second precision is lost
+	// with either timestamp; results within one second keep the order they were written
+	// in on the connection, and there is no option for a finer timestamp.
+	UseClientTimestamp bool
+	// AllowChunkedOutput splits plugin output that is too long for one packet across
+	// several packets for the same host and service, sent back to back on the connection.
+	// Each piece of output is prefixed with a "[i/n] " sequence marker (e.g. "[2/3] ").
+	// The receiving side must strip the markers and reassemble the pieces; a standard
+	// Nagios installation will not, and will record each piece as a separate result.
+	AllowChunkedOutput bool
+	// TruncationMarker, if set, is appended to plugin output that is too long for its
+	// packet field, after cutting the output short enough for the marker to fit, so that
+	// operators can tell the result was truncated (for example "...[truncated]").
+	// Without it, over-long output is cut silently. Either way the cut falls between
+	// UTF-8 sequences, as it does for long host names and services. It has no effect
+	// with AllowChunkedOutput, which sends the whole output instead.
+	TruncationMarker string
+	// MaxOutputBytes, if set below the protocol's limit of PluginOutputLength-1 bytes,
+	// is the most plugin output sent per result, for receivers that choke on less than
+	// the protocol allows. Longer output is cut to fit, with TruncationMarker if set, or
+	// with AllowChunkedOutput split into pieces of at most this size. It also applies to
+	// the NRDP transport, which has no limit of its own.
+	MaxOutputBytes int
+	// HostRewriter, if set, maps each message's Host to the name to send, just before the
+	// packet is encoded, so producers can use their own host identifiers and the mapping
+	// to the names Nagios knows lives in one place. It applies to every transport, and to
+	// heartbeats and keepalives too. Features that group messages by host and service,
+	// such as CoalesceByService and MinInterval, see the names before rewriting.
+	HostRewriter func(host string) string
+	// ServiceRewriter is HostRewriter for Message.Service.
+	ServiceRewriter func(service string) string
+	// SanitizeOutput rewrites plugin output that Nagios would otherwise misinterpret,
+	// before it is chunked or encoded:
+	//   - each line break ("\r\n", "\n" or "\r") becomes the two characters `\n`, which
+	//     Nagios 3 and later turn back into a line break in the long output, instead of
+	//     ending the external command early;
+	//   - each "|" becomes "¦" (U+00A6 BROKEN BAR), so the text is not split off as
+	//     performance data;
+	//   - every other control character, including tab and NUL, becomes a space.
+	// Nothing else is changed. Output that is meant to carry performance data must not
+	// be sent with SanitizeOutput.
+	SanitizeOutput bool
+	// ReplaceInvalidUTF8 replaces each invalid UTF-8 sequence in plugin output with the
+	// Unicode replacement character U+FFFD before it is sent. Without it, a message whose
+	// plugin output is not valid UTF-8 is not sent, and Send returns ErrInvalidUTF8.
+	ReplaceInvalidUTF8 bool
+	// CoalesceByService makes RunEndpoint, whenever messages are waiting in its channel,
+	// send only the newest waiting message for each host and service. The older ones are
+	// not sent and receive ErrSuperseded on their Status channels.
+	CoalesceByService bool
+	// DryRun skips the network entirely. Connect succeeds without dialing, using a random
+	// IV and the current time in place of the server's initialization packet, and Send
+	// encodes and encrypts packets as usual but writes them to DryRunOutput.
+	DryRun bool
+	// DryRunOutput receives the encoded packets in dry-run mode. If nil, they are discarded.
+	DryRunOutput io.Writer
+	// PriorityQueue makes RunEndpoint send waiting messages in order of Message.Priority,
+	// highest first, instead of in arrival order. Messages of equal priority, and messages
+	// sent while there is no backlog, are still sent in arrival order.
+	PriorityQueue bool
+	// IdleTimeout makes RunEndpoint close a connection that has not been used for longer
+	// than this before sending the next message on it, and reconnect instead. Set it below
+	// the idle timeout of any firewall between client and server, so that silently dropped
+	// connections are replaced rather than failing a send.
+	IdleTimeout time.Duration
+	// Heartbeat, if set along with HeartbeatInterval, is a message that RunEndpoint sends
+	// every HeartbeatInterval, so the monitoring side can tell the sender is alive. Its
+	// Status channel is not used.
+	Heartbeat *Message
+	// HeartbeatInterval is the interval between heartbeats.
+	HeartbeatInterval time.Duration
+	// AppKeepalive, if set, makes RunEndpoint send AppKeepaliveMessage whenever its open
+	// connection has carried nothing for AppKeepalive, for firewalls that time out flows
+	// without application traffic despite TCP keepalives. No connection is made just for
+	// a keepalive. The daemon has no no-op packet, so the keepalive is an ordinary result
+	// that Nagios processes like any other: point it at a passive service set up for the
+	// purpose, or it shows up as a stray result, or an error for an unknown service.
+	AppKeepalive time.Duration
+	// AppKeepaliveMessage is the message sent by AppKeepalive. It defaults to Heartbeat.
+	// Its Status channel is not used.
+	AppKeepaliveMessage *Message
+	// CoalesceHeartbeat skips a heartbeat when a message for the heartbeat's Host was sent
+	// successfully within the last HeartbeatInterval, since real traffic already shows
+	// the sender is alive. Heartbeats resume as soon as the host goes quiet.
+	CoalesceHeartbeat bool
+	// FinalHeartbeat makes RunEndpoint send one last copy of Heartbeat, with the plugin
+	// output "Shut down cleanly", when it shuts down, so that a planned shutdown can be told
+	// apart from a crash. It works with or without HeartbeatInterval.
+	FinalHeartbeat bool
+	// MinInterval makes RunEndpoint send at most one message per host and service every
+	// MinInterval. A message that arrives sooner after the last one sent is held back and
+	// sent once the interval has passed; if a newer message for the same host and service
+	// arrives in the meantime, it replaces the held one, which receives ErrDebounced on
+	// its Status channel. Held messages are sent without waiting when the endpoint shuts
+	// down.
+	MinInterval time.Duration
+	// MaxRetries makes RunEndpoint retry a message that failed to send up to MaxRetries
+	// more times, reconnecting before each retry. Errors that would only fail again are
+	// not retried (see DefaultShouldRetry). A message that fails every attempt is
+	// dropped: ErrRetriesExhausted, wrapping the last error, is reported on its Status
+	// channel and the endpoint moves on to the next message, so a message that can never
+	// be sent does not hold up the queue. With the default of zero, a message is only
+	// retried once, and only when the server had closed an existing connection.
+	MaxRetries int
+	// ShouldRetry, if set, replaces DefaultShouldRetry in deciding whether RunEndpoint
+	// retries a failed message. It is called with the error and the number of the retry
+	// about to be made, starting at 1, and can sleep to implement a backoff. MaxRetries,
+	// if set, still caps the number of retries; without it, ShouldRetry alone decides, so
+	// it must eventually return false.
+	ShouldRetry func(err error, retry int) bool
+	// BreakerThreshold enables a circuit breaker in RunEndpoint. After this many consecutive
+	// failures, messages fail immediately with ErrBreakerOpen for BreakerCooldown. The next
+	// message after the cooldown is sent as a trial: if it succeeds the breaker closes,
+	// otherwise it opens again. Zero disables the breaker.
+	BreakerThreshold int
+	// BreakerCooldown is how long the circuit breaker stays open. It defaults to 30 seconds.
+	BreakerCooldown time.Duration
+	// MinReconnectInterval is the least time RunEndpoint leaves between the start of one
+	// connection attempt, handshake included, and the next. A reconnect that would come
+	// sooner waits (see Sleep) for the rest of the interval, so a flapping server or a
+	// failover storm is not hammered with handshakes. It only paces connections; messages
+	// on an established connection are not delayed. Zero reconnects immediately.
+	MinReconnectInterval time.Duration
+	// PersistQueueDir, if set, makes an Endpoint created by StartEndpoint checkpoint the
+	// messages it has been given but not yet reported a result for to a file in this
+	// directory, at most once a second and when it shuts down. On start, it sends the
+	// messages left in the checkpoint by a previous process before any submitted ones, so
+	// queued results survive a crash; a crash between checkpoints can still lose the
+	// latest submissions, or send a message twice. Like a spool, the checkpoint keeps only
+	// the state, host, service and plugin output of each message; restored messages have
+	// no Status channel, so use OnResult to see their results. The directory must not be
+	// shared between endpoints.
+	PersistQueueDir string
+	// OnResult, if set, is called by RunEndpoint with each message and the result of its
+	// delivery attempt, after the result has been sent to the message's Status channel.
+	OnResult func(m *Message, err error)
+	// OnShutdown, if set, is called once when RunEndpoint stops, after its last message,
+	// with a summary of what was delivered, dropped and failed over its lifetime.
+	OnShutdown func(report ShutdownReport)
+	// EagerConnect makes RunEndpoint connect as soon as it starts instead of waiting for
+	// the first message. The outcome is reported to Logger.
+	EagerConnect bool
+	// StateChanges, if set, receives the connection state changes of RunEndpoint. Sends
+	// are non-blocking, so events are dropped if the channel is not ready.
+	StateChanges chan<- ConnState
+	// Clock, if set, replaces time.Now in reading the time: for packet timestamps with
+	// UseClientTimestamp, TimestampAge, IdleTimeout, the circuit breaker's cooldown,
+	// MinInterval, MinReconnectInterval, CoalesceHeartbeat, AppKeepalive and the pool's
+	// MaxConnAge. Network deadlines, Diagnose and BenchmarkCipher timings and spool file
+	// names always use the real clock.
+	Clock func() time.Time
+	// Sleep, if set, replaces time.Sleep in waiting out MinReconnectInterval.
+	Sleep func(time.Duration)
+	// After, if set, replaces time.After, and the timers and tickers built on it, for the
+	// package's own timers: the HeartbeatInterval, AppKeepalive and PersistQueueDir
+	// checkpoint ticks, the MinInterval delay and SubmitTimeout. Together with Clock and
+	// Sleep it lets a fake clock drive all of them. Waits bounded by network deadlines,
+	// such as ConfirmTCPAck, always use the real clock.
+	After func(time.Duration) <-chan time.Time
+	// StrictConfig makes Connect fail with ErrInsecureConfig, instead of logging a
+	// warning, when Password is set but EncryptionMethod is ENCRYPT_NONE, which usually
+	// means the encryption method was forgotten and messages would go out in the clear.
+	StrictConfig bool
+	// Logger, if set, receives diagnostic messages such as connection events.
+	Logger *log.Logger
+	// VerifyBeforeSend makes Send check that the connection is still open before writing
+	// to it, by attempting a read with a very short deadline. The daemon never sends
+	// anything after the initialization packet, so the read times out on a healthy
+	// connection, but returns at once if the daemon has closed or reset it, for example
+	// after a restart. Send then returns ErrConnectionClosed without writing the message,
+	// instead of the write appearing to succeed and the message being lost, and
+	// RunEndpoint reconnects and sends it again. Each send is delayed by up to a
+	// millisecond.
+	VerifyBeforeSend bool
+	// ConfirmTCPAck makes Send, SendBatch and SendStream wait, after writing, until the
+	// server's TCP stack has acknowledged every byte written, instead of returning as soon
+	// as the data is in the local socket buffer. This is not an acknowledgement from the
+	// daemon, which sends none, but it does show that the packets reached the server
+	// host. The wait is bounded by the write deadline (Timeout, or one second without
+	// one), after which ErrNotAcknowledged is returned. It is only supported on Linux;
+	// elsewhere every send fails.
+	ConfirmTCPAck bool
+	// BeforeWrite, if set, is called by Send, SendBatch and SendStream with each message
+	// and its encoded, encrypted packets (several with AllowChunkedOutput, each followed by
+	// its HMAC with HMACKey) just before they are written, for instrumentation such as
+	// sampling the raw bytes or starting a trace span. The callback may change the bytes,
+	// after VerifyOutgoing has checked them, but not how many are written, and must not
+	// keep the slice after it returns. It is not called for the NRDP transport.
+	BeforeWrite func(m *Message, packet []byte)
+	// VerifyOutgoing decodes every encrypted packet before it is sent and checks that it
+	// round trips back to the original message. Send returns an error instead of writing
+	// a packet that fails the check. Intended for staging and debugging.
+	VerifyOutgoing bool
+}
+
+func (s ServerInfo) network() string {
+	if s.Network == "" {
+		return "tcp"
+	}
+	return s.Network
+}
+
+func (s ServerInfo) address() string {
+	if s.network() == "unix" || s.Transport == NRDP {
+		return s.Host
+	}
+	return net.JoinHostPort(s.Host, s.Port)
+}
+
+// Redacted returns a copy of s with the password and HMAC key, if any, replaced by "****".
+func (s ServerInfo) Redacted() ServerInfo {
+	if s.Password != "" {
+		s.Password = "****"
+	}
+	if s.HMACKey != nil {
+		s.HMACKey = []byte("****")
+	}
+	return s
+}
+
+// String renders every field of s for logging, with the password redacted.
+func (s ServerInfo) String() string {
+	type fields ServerInfo // without the String method
+	return fmt.Sprintf("%+v", fields(s.Redacted()))
+}
+
+// readPasswordFile returns s with Password read from PasswordFile, if set.
+func (s ServerInfo) readPasswordFile() (ServerInfo, error) {
+	if s.PasswordFile == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(s.PasswordFile)
+	if err != nil {
+		return s, fmt.Errorf("Could not read NSCA password file: %w", err)
+	}
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	b = bytes.TrimSuffix(b, []byte("\r"))
+	s.Password = string(b)
+	clear(b)
+	return s, nil
+}
+
+func (s ServerInfo) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock()
+	}
+	return time.Now()
+}
+
+func (s ServerInfo) sleep(d time.Duration) {
+	if s.Sleep != nil {
+		s.Sleep(d)
+	} else {
+		time.Sleep(d)
+	}
+}
+
+// timer returns a channel that fires once after d, using After if set, and a function to
+// stop it.
+func (s ServerInfo) timer(d time.Duration) (<-chan time.Time, func()) {
+	if s.After == nil {
+		t := time.NewTimer(d)
+		return t.C, func() { t.Stop() }
+	}
+	return s.After(d), func() {}
+}
+
+// ticker returns a channel that fires every d, using After if set, and a function to
+// stop it. Like time.Ticker, it drops ticks for a slow receiver.
+func (s ServerInfo) ticker(d time.Duration) (<-chan time.Time, func()) {
+	if s.After == nil {
+		t := time.NewTicker(d)
+		return t.C, t.Stop
+	}
+	c := make(chan time.Time, 1)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case t := <-s.After(d):
+				select {
+				case c <- t:
+				default:
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return c, func() { once.Do(func() { close(stop) }) }
+}
+
+func (s ServerInfo) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+// CheckTarget identifies the host, or the service on a host, that a result is for.
+type CheckTarget struct {
+	// Host is the host name.
+	Host string
+	// Service is the service description. Leave empty for a host check result.
+	Service string
 }
 
 // Message is the contents of an NSCA message
 type Message struct {
 	// State is one of {STATE_OK, STATE_WARNING, STATE_CRITICAL, STATE_UNKNOWN}
 	State int16
-	// Host is the host name to set for the NSCA message
+	// Host is the host name to set for the NSCA message. Prefer NewMessage, which sets
+	// Host and Service together from a CheckTarget, so the two cannot be swapped.
 	Host string
-	// Service is the service name to set for the NSCA message [optional]
+	// Service is the service name to set for the NSCA message [optional]. See Host.
 	Service string
 	// Message is the "plugin output" of the NSCA message [optional]
 	Message string
+	// Priority orders waiting messages when ServerInfo.PriorityQueue is set. Higher values
+	// are sent first.
+	Priority int
 	// Status is an optional channel that recieves the status of a message delivery attempt
 	Status chan<- error
+	// Deadline, if set, replaces the connection's Timeout for the write of this message by
+	// Send (and so RunEndpoint). SendBatch and SendStream ignore it. A write abandoned
+	// because the deadline passed fails with an error wrapping context.DeadlineExceeded.
+	Deadline time.Time
+	// Submitter names the process or host that submitted the result, where it differs
+	// from Host. It is not sent: neither the NSCA data packet nor an NRDP check result
+	// has a submitter field, and the daemon attributes results to Host only. It is kept
+	// so callers can carry it alongside the message, like UserData.
+	Submitter string
+	// CheckInterval is how often the check behind the message runs, as a hint for the
+	// receiver's freshness threshold. It is not sent: the NSCA data packet, the
+	// PROCESS_SERVICE_CHECK_RESULT command the daemon makes of it and an NRDP check
+	// result have no interval, so freshness thresholds are still set in Nagios.
+	CheckInterval time.Duration
+	// UserData is never read or modified by this package. It is passed through to
+	// ServerInfo.OnResult so callers can correlate results with their own requests.
+	UserData interface{}
+}
+
+// NewMessage returns a message with the given result for target.
+func NewMessage(target CheckTarget, state int16, output string) *Message {
+	return &Message{State: state, Host: target.Host, Service: target.Service, Message: output}
 }
 
-// RunEndpoint creates a long-lived connection to an NSCA server. Messages sent into the messages
-// channel are sent to the NSCA server. Close the quit channel to end the routine. RunEndpoint
-// does it's own initialization, cleanup and error recovery and can safely be used from multiple threads.
-func RunEndpoint(connectInfo ServerInfo, quit <-chan interface{}, messages <-chan *Message) {
+// Target returns the host and service of m.
+func (m *Message) Target() CheckTarget {
+	return CheckTarget{Host: m.Host, Service: m.Service}
+}
+
+// WireSize returns how many bytes m occupies on the wire when sent with connectInfo, without
+// encoding it. NSCA data packets have a fixed size, so this is DataPacketSize, or a
+// multiple of it when AllowChunkedOutput splits long output across packets. It does not
+// include the initialization packet read once per connection, nor TLS overhead. For the
+// NRDP transport, whose requests vary in size, it returns zero.
+func (m *Message) WireSize(connectInfo ServerInfo) int {
+	if connectInfo.Transport == NRDP {
+		return 0
+	}
+	size := DataPacketSize
+	if connectInfo.HMACKey != nil {
+		size += HMACSize
+	}
+	if !connectInfo.AllowChunkedOutput {
+		return size
+	}
+	output, err := pluginOutput(m, connectInfo.SanitizeOutput, connectInfo.ReplaceInvalidUTF8)
+	if err != nil {
+		output = m.Message
+	}
+	return len(chunkOutput(output, outputLimit(connectInfo.MaxOutputBytes))) * size
+}
+
+// Send connects to an NSCA server, sends a single message and disconnects. The Status
+// channel of the message is not used.
+func Send(connectInfo ServerInfo, message *Message) error {
+	ctx, cancel := overallContext(connectInfo)
+	defer cancel()
+	if connectInfo.Transport == NRDP {
+		return sendNRDP(ctx, connectInfo, message)
+	}
 	server := new(NSCAServer)
 	defer server.Close()
-	var err error
-	for {
-		select {
-		case <-quit:
-			return
-		case m := <-messages:
-			if server.conn == nil {
-				err = server.Connect(connectInfo)
-			}
-			if err == nil {
-				err = server.Send(m)
-			}
-			if m.Status != nil {
-				m.Status <- err
-			}
-			if err != nil {
-				server.Close()
-				err = nil
-			}
-		}
+	err := server.connect(ctx, connectInfo)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	server.deadline, _ = ctx.Deadline()
+	return contextError(ctx, server.Send(message))
+}
+
+// Ping connects to an NSCA server and completes the handshake without sending a message.
+func Ping(connectInfo ServerInfo) error {
+	ctx, cancel := overallContext(connectInfo)
+	defer cancel()
+	server := new(NSCAServer)
+	defer server.Close()
+	return contextError(ctx, server.connect(ctx, connectInfo))
+}
+
+func overallContext(connectInfo ServerInfo) (context.Context, context.CancelFunc) {
+	if connectInfo.OverallTimeout > 0 {
+		return context.WithTimeout(context.Background(), connectInfo.OverallTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// contextError wraps err with the context's error if ctx was cancelled or its deadline
+// has passed, so that giving up can be told apart from a network failure. The deadline
+// is checked directly because a network deadline set from it can expire just before ctx
+// reports it.
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	cause := ctx.Err()
+	if d, ok := ctx.Deadline(); cause == nil && ok && !time.Now().Before(d) {
+		cause = context.DeadlineExceeded
+	}
+	if cause == nil || errors.Is(err, cause) {
+		return err
 	}
+	return fmt.Errorf("%w: %w", cause, err)
 }
 
 // NSCAServer can be used as a lower-level alternative to RunEndpoint. It is NOT safe
@@ -69,34 +528,190 @@ type NSCAServer struct {
 	conn            net.Conn
 	encryption      *encryption
 	serverTimestamp uint32
-	timeout         time.Duration
+	session         ServerInfo // the settings of the session, without the password
+	deadline        time.Time
+	handshakeTime   time.Time
+	padding         io.Reader    // see dataPacket; set by Encoder
+	sharedBlock     cipher.Block // keyed cipher to use instead of deriving one; set by NSCAPool
 }
 
 // Connect to an NSCA server.
 func (n *NSCAServer) Connect(connectInfo ServerInfo) error {
-	var conn net.Conn
-	var err error
+	return n.connect(context.Background(), connectInfo)
+}
+
+// connect dials and handshakes with the server. If ctx has a deadline, it bounds the dial
+// and the handshake.
+func (n *NSCAServer) connect(ctx context.Context, connectInfo ServerInfo) error {
+	if connectInfo.Transport == NRDP {
+		return ErrNRDPConnection
+	}
+	err := checkConfig(connectInfo)
+	if err != nil {
+		return err
+	}
+	conn, err := dial(ctx, connectInfo)
+	if err != nil {
+		return err
+	}
+	// cancelling ctx interrupts the handshake, as its deadline does
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	err = n.handshake(conn, connectInfo)
+	if !stop() && err == nil {
+		// cancelled as the handshake finished, leaving the deadline in the past
+		n.Close()
+		err = ctx.Err()
+	}
+	return err
+}
+
+// dial establishes the connection to the server, ready for the handshake: the network
+// connection with its TOS and deadline set and, if configured, TLS on top. In dry run
+// mode the connection is the synthetic one that serves a local initialization packet.
+func dial(ctx context.Context, connectInfo ServerInfo) (net.Conn, error) {
+	if connectInfo.DryRun {
+		return newDryRunConn(connectInfo.DryRunOutput)
+	}
+	conn, err := dialNetwork(ctx, connectInfo)
+	if err != nil {
+		return nil, err
+	}
+	if connectInfo.TOS != 0 {
+		err = setTOS(conn, connectInfo.TOS)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	if d := ioDeadline(connectInfo.Timeout, deadline); !d.IsZero() {
+		conn.SetDeadline(d)
+	}
+	if connectInfo.TLSConfig != nil {
+		return tlsHandshake(ctx, conn, connectInfo)
+	}
+	return conn, nil
+}
+
+// Handshake runs the NSCA handshake on a connection the caller opened, for example one
+// made through a proxy or over a pipe, instead of having Connect dial it. It reads the
+// server's initialization packet and, if successful, makes conn the server's connection,
+// replacing any existing one. If connectInfo.Timeout is set, it bounds reading the
+// packet. Only the encryption and send settings of connectInfo are used; TLS, TOS and
+// dialing are the caller's business. conn is closed on failure.
+func (n *NSCAServer) Handshake(conn net.Conn, connectInfo ServerInfo) error {
+	err := checkConfig(connectInfo)
+	if err != nil {
+		conn.Close()
+		return err
+	}
 	if connectInfo.Timeout > 0 {
-		conn, err = net.DialTimeout("tcp", net.JoinHostPort(connectInfo.Host, connectInfo.Port), connectInfo.Timeout)
-	} else {
-		conn, err = net.Dial("tcp", net.JoinHostPort(connectInfo.Host, connectInfo.Port))
+		conn.SetDeadline(time.Now().Add(connectInfo.Timeout))
+	}
+	return n.handshake(conn, connectInfo)
+}
+
+// ErrInsecureConfig is returned under ServerInfo.StrictConfig when a Password is set but
+// EncryptionMethod is ENCRYPT_NONE, so messages would be sent in the clear.
+var ErrInsecureConfig = errors.New("Password set but encryption is ENCRYPT_NONE; messages would be sent unencrypted")
+
+// checkConfig looks for configuration mistakes before connecting. Without StrictConfig,
+// they are logged rather than returned.
+func checkConfig(connectInfo ServerInfo) error {
+	if (connectInfo.Password != "" || connectInfo.PasswordFile != "") && connectInfo.EncryptionMethod == ENCRYPT_NONE &&
+		connectInfo.Transport == NSCA {
+		if connectInfo.StrictConfig {
+			return ErrInsecureConfig
+		}
+		connectInfo.logf("WARNING: NSCA password is set but encryption is ENCRYPT_NONE, messages to %s are sent unencrypted",
+			connectInfo.address())
+	}
+	return nil
+}
+
+// ioDeadline returns the deadline for a single network operation: timeout from now, but
+// never later than the overall deadline. A zero result means no deadline.
+func ioDeadline(timeout time.Duration, deadline time.Time) time.Time {
+	if timeout > 0 {
+		d := time.Now().Add(timeout)
+		if deadline.IsZero() || d.Before(deadline) {
+			return d
+		}
+	}
+	return deadline
+}
+
+// ErrTLSHandshake is returned, wrapping the underlying error, when the TLS handshake with
+// the server fails, for example because a certificate could not be verified.
+var ErrTLSHandshake = errors.New("TLS handshake failed")
+
+// tlsHandshake wraps conn in a TLS client connection and completes the handshake.
+// conn is closed on failure.
+func tlsHandshake(ctx context.Context, conn net.Conn, connectInfo ServerInfo) (net.Conn, error) {
+	config := connectInfo.TLSConfig.Clone()
+	if config.ServerName == "" && connectInfo.network() != "unix" {
+		config.ServerName = connectInfo.Host
 	}
+	tlsConn := tls.Client(conn, config)
+	err := tlsConn.HandshakeContext(ctx)
 	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w with %s: %w", ErrTLSHandshake, connectInfo.address(), err)
+	}
+	return tlsConn, nil
+}
+
+// handshake reads the initialization packet from an open connection and, if successful,
+// makes it the server's connection. conn is closed on failure.
+func (n *NSCAServer) handshake(conn net.Conn, connectInfo ServerInfo) error {
+	connectInfo, err := connectInfo.readPasswordFile()
+	if err != nil {
+		conn.Close()
 		return err
 	}
+	if connectInfo.EncryptionMethod != ENCRYPT_NONE && connectInfo.Password == "" {
+		conn.Close()
+		return ErrEmptyPassword
+	}
 	ip, err := readInitializationPacket(conn)
 	if err != nil {
 		conn.Close()
 		return err
 	}
 	n.Close()
-	n.encryption = newEncryption(connectInfo.EncryptionMethod, ip.iv, connectInfo.Password)
-	n.serverTimestamp = ip.timestamp
-	n.timeout = connectInfo.Timeout
+	err = n.setSession(connectInfo, ip)
+	if err != nil {
+		conn.Close()
+		return err
+	}
 	n.conn = conn
 	return nil
 }
 
+// setSession sets up n to encode packets for the session described by the initialization
+// packet ip. It fails, leaving n without a session, if the encryption cannot be set up.
+func (n *NSCAServer) setSession(connectInfo ServerInfo, ip *initializationPacket) error {
+	e := newEncryption(connectInfo.EncryptionMethod, ip.iv, connectInfo.Password)
+	e.keyDeriver = connectInfo.KeyDeriver
+	e.mode = connectInfo.BlockMode
+	if n.sharedBlock != nil {
+		e.block = n.sharedBlock
+	} else if err := e.prepare(); err != nil {
+		e.wipe()
+		return err
+	}
+	n.encryption = e
+	n.serverTimestamp = ip.timestamp
+	session := connectInfo
+	session.Password, session.PasswordFile = "", ""
+	if connectInfo.HMACKey != nil {
+		session.HMACKey = append([]byte{}, connectInfo.HMACKey...)
+	}
+	n.session = session
+	n.handshakeTime = connectInfo.now()
+	return nil
+}
+
 // Close the connection and clean up.
 func (n *NSCAServer) Close() {
 	if n.conn != nil {
@@ -104,16 +719,333 @@ func (n *NSCAServer) Close() {
 		n.conn = nil
 	}
 	n.serverTimestamp = 0
+	if n.encryption != nil {
+		n.encryption.wipe()
+	}
 	n.encryption = nil
-	n.timeout = 0
+	n.deadline = time.Time{}
+	clear(n.session.HMACKey)
+	n.session = ServerInfo{}
+	n.handshakeTime = time.Time{}
+	n.padding = nil
+}
+
+// CipherIVLen returns how many bytes of the server's IV the negotiated encryption method
+// uses: the block size for the block ciphers in CFB mode (8 for DES and 3DES, 16 for the
+// RIJNDAEL methods, whatever their key size), all InitIVLength bytes for ENCRYPT_XOR, and
+// zero for ENCRYPT_NONE. It is also zero if n is not connected or the method is not
+// supported.
+func (n *NSCAServer) CipherIVLen() int {
+	if n.encryption == nil {
+		return 0
+	}
+	return n.encryption.ivLen()
+}
+
+// TimestampAge returns how old the server timestamp cached by n is, that is, how long ago
+// the initialization packet was read. Every packet carries that timestamp, and the daemon
+// drops packets older than its max_packet_age setting, so callers can reconnect before the
+// age approaches that window. The age is measured on the local clock, so it is not
+// affected by clock skew between client and server. It is zero if n is not connected.
+func TimestampAge(n *NSCAServer) time.Duration {
+	if n.conn == nil {
+		return 0
+	}
+	return n.session.now().Sub(n.handshakeTime)
 }
 
 // Send an NSCA message.
 func (n *NSCAServer) Send(message *Message) error {
-	msg := newDataPacket(n.serverTimestamp, message.State, message.Host, message.Service, message.Message)
-	if n.timeout > 0 {
-		n.conn.SetDeadline(time.Now().Add(n.timeout))
+	return n.sendAt(message, n.timestamp())
+}
+
+// sendAt is Send with the given packet timestamp.
+func (n *NSCAServer) sendAt(message *Message, timestamp uint32) error {
+	b, err := n.encodeAt(message, timestamp)
+	if err != nil {
+		return err
+	}
+	d := ioDeadline(n.session.Timeout, n.deadline)
+	if !message.Deadline.IsZero() {
+		d = message.Deadline
+		if !n.deadline.IsZero() && n.deadline.Before(d) {
+			d = n.deadline
+		}
+	}
+	if n.session.VerifyBeforeSend {
+		err = n.probe()
+		if err != nil {
+			return err
+		}
+	}
+	// always set, so that a message's deadline does not linger for the next one
+	n.conn.SetDeadline(d)
+	n.callBeforeWrite(message, b)
+	err = classifyWriteError(writePacket(n.conn, b))
+	if err == nil && n.session.ConfirmTCPAck {
+		err = n.waitForAck(d)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) && !message.Deadline.IsZero() && d.Equal(message.Deadline) {
+		err = fmt.Errorf("%w: message deadline passed: %w", context.DeadlineExceeded, err)
+	}
+	return err
+}
+
+// callBeforeWrite passes b to ServerInfo.BeforeWrite, capped so that appending to it
+// cannot reach past the packet.
+func (n *NSCAServer) callBeforeWrite(m *Message, b []byte) {
+	if n.session.BeforeWrite != nil {
+		n.session.BeforeWrite(m, b[:len(b):len(b)])
+	}
+}
+
+// ErrNotAcknowledged is returned under ServerInfo.ConfirmTCPAck when the written packets
+// were not acknowledged by the server's TCP stack in time. They may still arrive.
+var ErrNotAcknowledged = errors.New("Written data not acknowledged by the server")
+
+// defaultAckTimeout bounds waitForAck when no other deadline applies.
+const defaultAckTimeout = time.Second
+
+// waitForAck waits until everything written to the connection has been acknowledged by
+// the peer, or until deadline (or defaultAckTimeout from now, if it is zero) has passed.
+func (n *NSCAServer) waitForAck(deadline time.Time) error {
+	if _, ok := n.conn.(*dryRunConn); ok {
+		return nil
+	}
+	if deadline.IsZero() {
+		deadline = time.Now().Add(defaultAckTimeout)
+	}
+	for {
+		pending, err := unacknowledged(n.conn)
+		if err != nil {
+			return err
+		}
+		if pending == 0 {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%w: %d bytes outstanding", ErrNotAcknowledged, pending)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// probeTimeout is how long probe waits for the connection to report a close.
+const probeTimeout = time.Millisecond
+
+// Alive reports whether n is connected and the server has not closed the connection, as
+// far as can be told without writing to it (see ServerInfo.VerifyBeforeSend).
+func (n *NSCAServer) Alive() bool {
+	return n.conn != nil && n.probe() == nil
+}
+
+// probe attempts a read with a short deadline, which times out on an open connection.
+// It returns ErrConnectionClosed, wrapping the read error, if the connection was closed.
+func (n *NSCAServer) probe() error {
+	n.conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	defer n.conn.SetReadDeadline(time.Time{})
+	var b [1]byte
+	_, err := n.conn.Read(b[:])
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		// the daemon sends nothing more; unexpected data does not mean it is gone
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrConnectionClosed, err)
+}
+
+// ErrConnectionClosed is returned by Send, wrapping the underlying error, when the write
+// failed because the server had already closed or reset the connection. The message was
+// not accepted. Messages sent before it on the same connection, including earlier ones
+// of the same batch, were written, but the daemon may not have read them before closing.
+var ErrConnectionClosed = errors.New("Connection closed by NSCA server")
+
+func classifyWriteError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return fmt.Errorf("%w: %w", ErrConnectionClosed, err)
 	}
-	err := msg.write(n.conn, n.encryption)
 	return err
 }
+
+// sendReconnecting sends a message, connecting first if needed. Like Endpoint.deliver, it
+// reconnects and tries again once if the server had closed an existing connection. The
+// connection is closed after a failure. With the NRDP transport, which has no connection,
+// it submits the message in its own request instead.
+func (n *NSCAServer) sendReconnecting(connectInfo ServerInfo, message *Message) error {
+	if connectInfo.Transport == NRDP {
+		ctx, cancel := overallContext(connectInfo)
+		defer cancel()
+		return sendNRDP(ctx, connectInfo, message)
+	}
+	var err error
+	reused := n.conn != nil
+	if !reused {
+		err = n.Connect(connectInfo)
+	}
+	if err == nil {
+		err = n.Send(message)
+	}
+	if reused && errors.Is(err, ErrConnectionClosed) {
+		n.Close()
+		err = n.Connect(connectInfo)
+		if err == nil {
+			err = n.Send(message)
+		}
+	}
+	if err != nil {
+		n.Close()
+	}
+	return err
+}
+
+// SendBatch sends a slice of NSCA messages over the connection, buffering the writes.
+// It stops at the first error; messages before the failed one may or may not have been
+// delivered. The Status channels of the messages are not used. Every packet of the batch
+// carries the same timestamp, taken when the batch starts: the server's, or the client's
+// with UseClientTimestamp. SendBatch never reconnects; after an error, send the batch
+// again in full after reconnecting, and it then carries the new session's timestamp.
+func (n *NSCAServer) SendBatch(messages []*Message) error {
+	i := 0
+	return n.sendEach(func() *Message {
+		if i == len(messages) {
+			return nil
+		}
+		i++
+		return messages[i-1]
+	})
+}
+
+// SendStream sends every message received from messages until the channel is closed,
+// buffering the writes. Like SendBatch, it stops at the first error, does not use the
+// Status channels of the messages and gives every packet the timestamp of its start.
+func (n *NSCAServer) SendStream(messages <-chan *Message) error {
+	return n.sendEach(func() *Message {
+		return <-messages
+	})
+}
+
+// sendEach encodes and writes messages returned by next until it returns nil. Without a
+// maximum batch size, the deadline is reset before each write. Otherwise the buffer is
+// flushed and the deadline reset every maxBatchSize messages.
+func (n *NSCAServer) sendEach(next func() *Message) error {
+	w := bufio.NewWriterSize(checkedWriter{n.conn}, 16*DataPacketSize)
+	timestamp := n.timestamp()
+	count := 0
+	for m := next(); m != nil; m = next() {
+		b, err := n.encodeAt(m, timestamp)
+		if err != nil {
+			return err
+		}
+		if n.session.MaxBatchSize <= 0 || count%n.session.MaxBatchSize == 0 {
+			n.conn.SetDeadline(ioDeadline(n.session.Timeout, n.deadline))
+		}
+		n.callBeforeWrite(m, b)
+		// a short write to the connection is reported by checkedWriter
+		_, err = w.Write(b)
+		if err != nil {
+			return classifyWriteError(err)
+		}
+		count++
+		if n.session.MaxBatchSize > 0 && count%n.session.MaxBatchSize == 0 {
+			err = w.Flush()
+			if err != nil {
+				return classifyWriteError(err)
+			}
+		}
+	}
+	err := classifyWriteError(w.Flush())
+	if err == nil && n.session.ConfirmTCPAck {
+		err = n.waitForAck(ioDeadline(n.session.Timeout, n.deadline))
+	}
+	return err
+}
+
+// timestamp returns the timestamp for packets sent now: the server's, or the client's
+// with UseClientTimestamp.
+func (n *NSCAServer) timestamp() uint32 {
+	if n.session.UseClientTimestamp {
+		return uint32(n.session.now().Unix())
+	}
+	return n.serverTimestamp
+}
+
+// encode builds and encrypts the data packet for a message. With chunked output enabled,
+// a long message is encoded as several consecutive packets.
+func (n *NSCAServer) encode(message *Message) ([]byte, error) {
+	return n.encodeAt(message, n.timestamp())
+}
+
+// encodeAt is encode with the given packet timestamp.
+func (n *NSCAServer) encodeAt(message *Message, timestamp uint32) ([]byte, error) {
+	output, err := pluginOutput(message, n.session.SanitizeOutput, n.session.ReplaceInvalidUTF8)
+	if err != nil {
+		return nil, err
+	}
+	outputs := []string{output}
+	limit := outputLimit(n.session.MaxOutputBytes)
+	if n.session.AllowChunkedOutput {
+		outputs = chunkOutput(output, limit)
+	} else {
+		outputs[0] = truncateOutput(output, n.session.TruncationMarker, limit)
+	}
+	// cut here rather than in the packet, which would split a UTF-8 sequence
+	host, service := rewriteTarget(message, n.session.HostRewriter, n.session.ServiceRewriter)
+	host = truncateOutput(host, "", HostNameLength-1)
+	service = truncateOutput(service, "", ServiceLength-1)
+	var b []byte
+	for _, output := range outputs {
+		msg := newDataPacket(timestamp, message.State, host, service, output)
+		msg.padding = n.padding
+		msg.hmacKey = n.session.HMACKey
+		msg.crc = n.session.CRC
+		p, err := msg.encode(n.encryption)
+		if err != nil {
+			return nil, err
+		}
+		if n.session.VerifyOutgoing {
+			err = msg.verify(p[:DataPacketSize], n.encryption)
+			if err != nil {
+				return nil, err
+			}
+		}
+		b = append(b, p...)
+	}
+	return b, nil
+}
+
+// chunkOutput splits output into pieces of at most max bytes, each prefixed with a
+// "[i/n] " sequence marker and cut between UTF-8 sequences. Output that already fits is
+// returned unchanged.
+func chunkOutput(output string, max int) []string {
+	if len(output) <= max {
+		return []string{output}
+	}
+	for count := 2; ; count++ {
+		size := max - len(fmt.Sprintf("[%d/%d] ", count, count))
+		if size < utf8.UTFMax {
+			// too small for the markers to leave room for any output
+			return []string{truncateOutput(output, "", max)}
+		}
+		var pieces []string
+		for rest := output; rest != ""; {
+			end := len(rest)
+			if end > size {
+				end = size
+				for !utf8.RuneStart(rest[end]) {
+					end--
+				}
+			}
+			pieces = append(pieces, rest[:end])
+			rest = rest[end:]
+		}
+		if len(pieces) > count {
+			continue
+		}
+		// fewer pieces than count only shortens the markers
+		chunks := make([]string, len(pieces))
+		for i, piece := range pieces {
+			chunks[i] = fmt.Sprintf("[%d/%d] %s", i+1, len(pieces), piece)
+		}
+		return chunks
+	}
+}
@@ -0,0 +1,1918 @@
+package nsca
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestCaptureSend(t *testing.T) {
+	iv := make([]byte, 128)
+	rand.Read(iv)
+	info := ServerInfo{EncryptionMethod: ENCRYPT_RIJNDAEL128, Password: "testpassword"}
+	messages := []*Message{
+		&Message{State: STATE_OK, Host: "host1", Service: "service1", Message: "first"},
+		&Message{State: STATE_WARNING, Host: "host2", Service: "service2", Message: "second"},
+	}
+	b, err := CaptureSend(info, iv, 1234, messages...)
+	if err != nil {
+		t.Fatalf("Error capturing send: %s", err)
+	}
+	if len(b) != 720*len(messages) {
+		t.Fatalf("Bad capture length: expected %d, got %d", 720*len(messages), len(b))
+	}
+	enc := newEncryption(info.EncryptionMethod, iv, info.Password)
+	for i, m := range messages {
+		p, err := decodeDataPacket(b[i*720:(i+1)*720], enc)
+		if err != nil {
+			t.Errorf("Error decoding packet %d: %s", i, err)
+			continue
+		}
+		if p.timestamp != 1234 || p.returnCode != m.State || p.hostName != m.Host ||
+			p.serviceDescription != m.Service || p.pluginOutput != m.Message {
+			t.Errorf("Bad packet %d: %+v", i, p)
+		}
+	}
+}
+
+func TestPingOverallTimeout(t *testing.T) {
+	// a server that accepts but never sends an initialization packet
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	info := ServerInfo{Host: host, Port: port, Timeout: time.Second, OverallTimeout: 100 * time.Millisecond}
+	start := time.Now()
+	err = Ping(info)
+	if err == nil {
+		t.Fatalf("Ping should have timed out")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Ping took %s, expected about %s", elapsed, info.OverallTimeout)
+	}
+}
+
+// pipeServer returns an NSCAServer connected to one end of a net.Pipe, and a channel that
+// receives everything written to the pipe once the server is closed.
+func pipeServer(t *testing.T, info ServerInfo) (*NSCAServer, []byte, <-chan []byte) {
+	client, server := net.Pipe()
+	iv := make([]byte, 128)
+	rand.Read(iv)
+	captured := make(chan []byte, 1)
+	go func() {
+		defer server.Close()
+		server.Write(append(append([]byte{}, iv...), 0, 0, 0x04, 0xd2))
+		b, _ := io.ReadAll(server)
+		captured <- b
+	}()
+	n := new(NSCAServer)
+	err := n.handshake(client, info)
+	if err != nil {
+		t.Fatalf("Handshake failed: %s", err)
+	}
+	return n, iv, captured
+}
+
+func TestSendStream(t *testing.T) {
+	info := ServerInfo{EncryptionMethod: ENCRYPT_XOR, Password: "testpassword"}
+	n, iv, captured := pipeServer(t, info)
+	messages := make(chan *Message)
+	go func() {
+		for i := 0; i < 50; i++ {
+			messages <- &Message{State: STATE_OK, Host: "host", Service: "service", Message: "stream"}
+		}
+		close(messages)
+	}()
+	err := n.SendStream(messages)
+	if err != nil {
+		t.Fatalf("Error sending stream: %s", err)
+	}
+	n.Close()
+	b := <-captured
+	if len(b) != 50*720 {
+		t.Fatalf("Bad stream length: expected %d, got %d", 50*720, len(b))
+	}
+	enc := newEncryption(info.EncryptionMethod, iv, info.Password)
+	for i := 0; i < 50; i++ {
+		p, err := decodeDataPacket(b[i*720:(i+1)*720], enc)
+		if err != nil {
+			t.Fatalf("Error decoding packet %d: %s", i, err)
+		}
+		if p.timestamp != 1234 || p.pluginOutput != "stream" {
+			t.Errorf("Bad packet %d: %+v", i, p)
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := t.TempDir() + "/nsca.sock"
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(make([]byte, 132))
+		io.Copy(io.Discard, conn)
+	}()
+	err = Send(ServerInfo{Network: "unix", Host: path}, &Message{State: STATE_OK, Host: "host"})
+	if err != nil {
+		t.Errorf("Error sending over unix socket: %s", err)
+	}
+}
+
+func TestTOSNeedsTCP(t *testing.T) {
+	path, _ := unixServer(t)
+	err := Send(ServerInfo{Network: "unix", Host: path, TOS: 0x20}, &Message{Host: "host"})
+	if err == nil {
+		t.Errorf("Expected an error setting TOS on a unix socket")
+	}
+}
+
+func TestEndpointReconnectsAfterServerClose(t *testing.T) {
+	// a single-use server: one packet per connection
+	path := t.TempDir() + "/nsca.sock"
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	received := make(chan int, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write(make([]byte, 132))
+			n, _ := io.ReadFull(conn, make([]byte, 720))
+			conn.Close()
+			received <- n
+		}
+	}()
+	quit := make(chan interface{})
+	defer close(quit)
+	messages := make(chan *Message)
+	states := make(chan ConnState, 20)
+	go RunEndpoint(ServerInfo{Network: "unix", Host: path, StateChanges: states}, quit, messages)
+	for i := 0; i < 3; i++ {
+		status := make(chan error, 1)
+		messages <- &Message{State: STATE_OK, Host: "host", Status: status}
+		if err := <-status; err != nil {
+			t.Errorf("Message %d failed: %s", i, err)
+		}
+		if n := <-received; n != 720 {
+			t.Errorf("Message %d: server received %d bytes", i, n)
+		}
+	}
+	expected := []ConnState{Connected,
+		Disconnected, Reconnecting, Connected,
+		Disconnected, Reconnecting, Connected}
+	for i, s := range expected {
+		select {
+		case got := <-states:
+			if got != s {
+				t.Errorf("State change %d: expected %s, got %s", i, s, got)
+			}
+		default:
+			t.Fatalf("State change %d: expected %s, got nothing", i, s)
+		}
+	}
+}
+
+func TestEndpointMessagesClosed(t *testing.T) {
+	path, received := unixServer(t)
+	messages := make(chan *Message, 1)
+	status := make(chan error, 1)
+	messages <- &Message{Host: "host", Status: status}
+	close(messages)
+	// closing the messages channel instead of quit ends the endpoint
+	done := make(chan struct{})
+	go func() {
+		RunEndpoint(ServerInfo{Network: "unix", Host: path}, make(chan interface{}), messages)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("RunEndpoint did not return after its messages channel was closed")
+	}
+	if err := <-status; err != nil {
+		t.Errorf("Message failed: %s", err)
+	}
+	if b := <-received; len(b) != 720 {
+		t.Errorf("Expected 1 packet, got %d bytes", len(b))
+	}
+}
+
+func TestUserData(t *testing.T) {
+	path, _ := unixServer(t)
+	type request struct{ id string }
+	data := &request{"trace-1"}
+	results := make(chan *Message, 1)
+	info := ServerInfo{Network: "unix", Host: path, OnResult: func(m *Message, err error) {
+		results <- m
+	}}
+	quit := make(chan interface{})
+	defer close(quit)
+	messages := make(chan *Message)
+	go RunEndpoint(info, quit, messages)
+	messages <- &Message{Host: "host", UserData: data}
+	// OnResult gets the caller's value back, untouched
+	if m := <-results; m.UserData != data || data.id != "trace-1" {
+		t.Errorf("Expected the message's UserData %v, got %v", data, m.UserData)
+	}
+}
+
+func TestChunkedOutput(t *testing.T) {
+	iv := make([]byte, 128)
+	output := strings.Repeat("0123456789", 120)
+	info := ServerInfo{AllowChunkedOutput: true}
+	b, err := CaptureSend(info, iv, 1234, &Message{State: STATE_OK, Host: "host", Message: output})
+	if err != nil {
+		t.Fatalf("Error capturing send: %s", err)
+	}
+	if len(b) != 3*720 {
+		t.Fatalf("Expected 3 packets, got %d bytes", len(b))
+	}
+	enc := newEncryption(ENCRYPT_NONE, iv, "")
+	var reassembled string
+	for i := 0; i < 3; i++ {
+		p, err := decodeDataPacket(b[i*720:(i+1)*720], enc)
+		if err != nil {
+			t.Fatalf("Error decoding packet %d: %s", i, err)
+		}
+		prefix := fmt.Sprintf("[%d/3] ", i+1)
+		if !strings.HasPrefix(p.pluginOutput, prefix) {
+			t.Fatalf("Packet %d is missing marker %q: %q", i, prefix, p.pluginOutput)
+		}
+		reassembled += strings.TrimPrefix(p.pluginOutput, prefix)
+	}
+	if reassembled != output {
+		t.Errorf("Bad reassembled output: %q", reassembled)
+	}
+
+	// pieces of multi-byte output are cut between runes
+	output = strings.Repeat("é", 300)
+	chunks := chunkOutput(output, PluginOutputLength-1)
+	reassembled = ""
+	for i, chunk := range chunks {
+		prefix := fmt.Sprintf("[%d/%d] ", i+1, len(chunks))
+		if !strings.HasPrefix(chunk, prefix) || len(chunk) > PluginOutputLength-1 || !utf8.ValidString(chunk) {
+			t.Fatalf("Bad chunk %d of %d: %d bytes %q", i, len(chunks), len(chunk), chunk)
+		}
+		reassembled += strings.TrimPrefix(chunk, prefix)
+	}
+	if len(chunks) != 2 || reassembled != output {
+		t.Errorf("Bad reassembled multi-byte output in %d chunks: %q", len(chunks), reassembled)
+	}
+}
+
+// unixServer starts a fake NSCA server on a Unix socket. It sends a zero initialization
+// packet on each connection and delivers everything read from the connection once the
+// client closes it.
+func unixServer(t *testing.T) (string, <-chan []byte) {
+	path := t.TempDir() + "/nsca.sock"
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received := make(chan []byte, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write(make([]byte, 132))
+				b, _ := io.ReadAll(conn)
+				received <- b
+			}()
+		}
+	}()
+	return path, received
+}
+
+func TestCoalesceByService(t *testing.T) {
+	path, received := unixServer(t)
+	messages := make(chan *Message, 10)
+	var statuses []chan error
+	for _, m := range []*Message{
+		{Host: "a", Message: "a1"},
+		{Host: "b", Message: "b1"},
+		{Host: "a", Message: "a2"},
+		{Host: "a", Message: "a3"},
+	} {
+		status := make(chan error, 1)
+		m.Status = status
+		statuses = append(statuses, status)
+		messages <- m
+	}
+	close(messages)
+	RunEndpoint(ServerInfo{Network: "unix", Host: path, CoalesceByService: true}, nil, messages)
+	for i, expected := range []error{ErrSuperseded, nil, ErrSuperseded, nil} {
+		if err := <-statuses[i]; err != expected {
+			t.Errorf("Message %d: expected %v, got %v", i, expected, err)
+		}
+	}
+	b := <-received
+	if len(b) != 2*720 {
+		t.Fatalf("Expected 2 packets, got %d bytes", len(b))
+	}
+	enc := newEncryption(ENCRYPT_NONE, make([]byte, 128), "")
+	for i, s := range []string{"b1", "a3"} {
+		p, err := decodeDataPacket(b[i*720:(i+1)*720], enc)
+		if err != nil || p.pluginOutput != s {
+			t.Errorf("Packet %d: expected %q, got %+v (%v)", i, s, p, err)
+		}
+	}
+}
+
+func TestEndpointUpdateConfig(t *testing.T) {
+	path, received := unixServer(t)
+	info := ServerInfo{Network: "unix", Host: path, EncryptionMethod: ENCRYPT_XOR, Password: "old"}
+	e := NewEndpoint(info)
+	messages := make(chan *Message)
+	done := make(chan struct{})
+	go func() {
+		e.Run(nil, messages)
+		close(done)
+	}()
+	status := make(chan error, 1)
+	messages <- &Message{Host: "host", Message: "before", Status: status}
+	if err := <-status; err != nil {
+		t.Fatalf("Error sending before update: %s", err)
+	}
+	info.Password = "new"
+	if err := e.UpdateConfig(info); err != nil {
+		t.Fatalf("Error updating config: %s", err)
+	}
+	messages <- &Message{Host: "host", Message: "after", Status: status}
+	if err := <-status; err != nil {
+		t.Fatalf("Error sending after update: %s", err)
+	}
+	close(messages)
+	<-done
+	for _, expected := range []struct{ password, output string }{{"old", "before"}, {"new", "after"}} {
+		b := <-received
+		p, err := decodeDataPacket(b, newEncryption(ENCRYPT_XOR, make([]byte, 128), expected.password))
+		if err != nil || p.pluginOutput != expected.output {
+			t.Errorf("Expected %q with password %q, got %+v (%v)", expected.output, expected.password, p, err)
+		}
+	}
+	info.EncryptionMethod = ENCRYPT_GOST
+	if err := e.UpdateConfig(info); !errors.Is(err, ErrEncryptionUnsupported) {
+		t.Errorf("Expected ErrEncryptionUnsupported, got %v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var out bytes.Buffer
+	info := ServerInfo{Host: "nsca.invalid", Port: "5667", EncryptionMethod: ENCRYPT_3DES,
+		Password: "testpassword", DryRun: true, DryRunOutput: &out, VerifyOutgoing: true}
+	err := Send(info, &Message{State: STATE_OK, Host: "host", Message: "dry run"})
+	if err != nil {
+		t.Fatalf("Error in dry run: %s", err)
+	}
+	if out.Len() != 720 {
+		t.Errorf("Expected one packet, got %d bytes", out.Len())
+	}
+}
+
+func TestTimestampAge(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	info := ServerInfo{DryRun: true, Clock: func() time.Time { return now }}
+	n := new(NSCAServer)
+	if age := TimestampAge(n); age != 0 {
+		t.Errorf("Expected zero age before connecting, got %s", age)
+	}
+	err := n.Connect(info)
+	if err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	now = now.Add(90 * time.Second)
+	if age := TimestampAge(n); age != 90*time.Second {
+		t.Errorf("Expected 90s age, got %s", age)
+	}
+	n.Close()
+	if age := TimestampAge(n); age != 0 {
+		t.Errorf("Expected zero age after closing, got %s", age)
+	}
+}
+
+func TestCipherIVLen(t *testing.T) {
+	n := new(NSCAServer)
+	if l := n.CipherIVLen(); l != 0 {
+		t.Errorf("Expected zero before connecting, got %d", l)
+	}
+	for method, expected := range map[int]int{
+		ENCRYPT_NONE:        0,
+		ENCRYPT_XOR:         InitIVLength,
+		ENCRYPT_DES:         8,
+		ENCRYPT_3DES:        8,
+		ENCRYPT_RIJNDAEL128: 16,
+		ENCRYPT_RIJNDAEL256: 16,
+	} {
+		err := n.Connect(ServerInfo{DryRun: true, EncryptionMethod: method, Password: "password"})
+		if err != nil {
+			t.Fatalf("Error connecting with method %d: %s", method, err)
+		}
+		if l := n.CipherIVLen(); l != expected {
+			t.Errorf("Method %d: expected IV length %d, got %d", method, expected, l)
+		}
+		n.Close()
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	path, received := unixServer(t)
+	messages := make(chan *Message, 10)
+	for i, priority := range []int{0, 0, 5, 1, 5} {
+		messages <- &Message{Host: "host", Message: fmt.Sprint(i), Priority: priority}
+	}
+	close(messages)
+	RunEndpoint(ServerInfo{Network: "unix", Host: path, PriorityQueue: true}, nil, messages)
+	b := <-received
+	if len(b) != 5*720 {
+		t.Fatalf("Expected 5 packets, got %d bytes", len(b))
+	}
+	enc := newEncryption(ENCRYPT_NONE, make([]byte, 128), "")
+	for i, s := range []string{"2", "4", "3", "0", "1"} {
+		p, err := decodeDataPacket(b[i*720:(i+1)*720], enc)
+		if err != nil || p.pluginOutput != s {
+			t.Errorf("Packet %d: expected %q, got %+v (%v)", i, s, p, err)
+		}
+	}
+}
+
+// slowWriter discards what is written after a short pause.
+type slowWriter struct{}
+
+func (slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return len(b), nil
+}
+
+func TestSubmitTimeoutDuringUpdate(t *testing.T) {
+	// run with -race: SubmitTimeout waits on the queue while Run applies new settings
+	info := ServerInfo{DryRun: true, DryRunOutput: slowWriter{}}
+	e := StartEndpoint(info, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			e.UpdateConfig(info)
+			e.Submit(&Message{Host: "update"})
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		if err := e.SubmitTimeout(&Message{Host: "timeout"}, time.Second); err != nil {
+			t.Errorf("Error submitting: %s", err)
+		}
+	}
+	<-done
+	e.Close()
+}
+
+func TestSubmitTimeout(t *testing.T) {
+	// a server that never completes the handshake keeps the endpoint busy
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	e := StartEndpoint(ServerInfo{Host: host, Port: port, Timeout: 300 * time.Millisecond}, 1)
+	status := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		if err := e.Submit(&Message{Host: "host", Status: status}); err != nil {
+			t.Fatalf("Error submitting message %d: %s", i, err)
+		}
+	}
+	if err := e.SubmitTimeout(&Message{Host: "host"}, 50*time.Millisecond); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	if err := e.Close(); err == nil {
+		t.Errorf("Close should report the failure of the queued message")
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-status; err == nil {
+			t.Errorf("Message %d should have failed", i)
+		}
+	}
+	if err := e.Submit(&Message{Host: "host"}); err != ErrEndpointStopped {
+		t.Errorf("Expected ErrEndpointStopped, got %v", err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	info := ServerInfo{
+		Network:          "unix",
+		Host:             t.TempDir() + "/missing.sock",
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+		Clock:            func() time.Time { return now },
+	}
+	e := NewEndpoint(info)
+	send := func() error {
+		status := make(chan error, 1)
+		e.deliver(&Message{Host: "host", Status: status})
+		return <-status
+	}
+	for i := 0; i < 2; i++ {
+		if err := send(); err == nil || err == ErrBreakerOpen {
+			t.Fatalf("Attempt %d: expected a connection error, got %v", i, err)
+		}
+	}
+	if err := send(); err != ErrBreakerOpen {
+		t.Errorf("Expected ErrBreakerOpen, got %v", err)
+	}
+	// after the cooldown one trial is allowed, and its failure opens the breaker again
+	now = now.Add(2 * time.Minute)
+	if err := send(); err == nil || err == ErrBreakerOpen {
+		t.Errorf("Expected a trial send after the cooldown, got %v", err)
+	}
+	if err := send(); err != ErrBreakerOpen {
+		t.Errorf("Expected ErrBreakerOpen after a failed trial, got %v", err)
+	}
+}
+
+func TestEndpointClose(t *testing.T) {
+	path, received := unixServer(t)
+	var closer io.Closer = StartEndpoint(ServerInfo{Network: "unix", Host: path}, 10)
+	e := closer.(*Endpoint)
+	for i := 0; i < 5; i++ {
+		if err := e.Submit(&Message{Host: "host"}); err != nil {
+			t.Fatalf("Error submitting message %d: %s", i, err)
+		}
+	}
+	if err := closer.Close(); err != nil {
+		t.Errorf("Error closing endpoint: %s", err)
+	}
+	if b := <-received; len(b) != 5*720 {
+		t.Errorf("Expected all 5 queued messages to be delivered, got %d bytes", len(b))
+	}
+	if err := closer.Close(); err != nil {
+		t.Errorf("Second Close returned %v", err)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	path, _ := unixServer(t)
+	e := StartEndpoint(ServerInfo{Network: "unix", Host: path, EagerConnect: true}, 1)
+	defer e.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := e.WaitReady(ctx); err != nil {
+		t.Errorf("Expected the endpoint to become ready, got %v", err)
+	}
+
+	down := StartEndpoint(ServerInfo{Network: "unix", Host: path + ".missing", EagerConnect: true}, 1)
+	defer down.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := down.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestShutdownReport(t *testing.T) {
+	path, _ := unixServer(t)
+	reports := make(chan ShutdownReport, 1)
+	e := StartEndpoint(ServerInfo{
+		Network:    "unix",
+		Host:       path,
+		OnShutdown: func(r ShutdownReport) { reports <- r },
+	}, 5)
+	e.Submit(&Message{State: STATE_OK, Host: "host", Message: "one"})
+	e.Submit(&Message{State: STATE_OK, Host: "host", Message: "bad\xff"})
+	e.Submit(&Message{State: STATE_OK, Host: "host", Message: "two"})
+	e.Close()
+	r := <-reports
+	if r.Delivered != 2 || r.Failed != 1 || r.Dropped != 0 || !errors.Is(r.LastError, ErrInvalidUTF8) {
+		t.Errorf("Bad shutdown report %+v", r)
+	}
+	if e.Report() != r {
+		t.Errorf("Report %+v differs from the shutdown report %+v", e.Report(), r)
+	}
+}
+
+func TestEndpointCancel(t *testing.T) {
+	path, received := unixServer(t)
+	started, unblock := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	e := StartEndpoint(ServerInfo{Network: "unix", Host: path, OnResult: func(*Message, error) {
+		once.Do(func() {
+			close(started)
+			<-unblock
+		})
+	}}, 10)
+	statuses := make([]chan error, 5)
+	for i := range statuses {
+		statuses[i] = make(chan error, 1)
+		if err := e.Submit(&Message{Host: "host", Status: statuses[i]}); err != nil {
+			t.Fatalf("Error submitting message %d: %s", i, err)
+		}
+	}
+	<-started
+	if n := e.InFlight(); n != 4 {
+		t.Errorf("Expected 4 messages in flight, got %d", n)
+	}
+	cancelled := make(chan int)
+	go func() { cancelled <- e.Cancel() }()
+	for !e.cancelling() {
+		time.Sleep(time.Millisecond)
+	}
+	close(unblock)
+	if n := <-cancelled; n != 4 {
+		t.Errorf("Expected 4 cancelled messages, got %d", n)
+	}
+	for i, status := range statuses {
+		expected := ErrCancelled
+		if i == 0 {
+			expected = nil
+		}
+		if err := <-status; err != expected {
+			t.Errorf("Message %d: expected %v, got %v", i, expected, err)
+		}
+	}
+	if b := <-received; len(b) != 720 {
+		t.Errorf("Expected only the first message to be sent, got %d bytes", len(b))
+	}
+	if n := e.InFlight(); n != 0 {
+		t.Errorf("Expected nothing in flight after Cancel, got %d", n)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	path, received := unixServer(t)
+	now := time.Unix(1000000, 0)
+	states := make(chan ConnState, 10)
+	e := NewEndpoint(ServerInfo{Network: "unix", Host: path, IdleTimeout: time.Minute,
+		StateChanges: states, Clock: func() time.Time { return now }})
+	defer e.disconnect()
+	for _, wait := range []time.Duration{0, 30 * time.Second, 2 * time.Minute} {
+		now = now.Add(wait)
+		status := make(chan error, 1)
+		e.deliver(&Message{Host: "host", Status: status})
+		if err := <-status; err != nil {
+			t.Fatalf("Error sending after %s: %s", wait, err)
+		}
+	}
+	// the first connection carried two messages before going idle
+	if b := <-received; len(b) != 2*720 {
+		t.Errorf("Expected 2 packets on the first connection, got %d bytes", len(b))
+	}
+	expected := []ConnState{Connected, Disconnected, Reconnecting, Connected}
+	for i, s := range expected {
+		if got := <-states; got != s {
+			t.Errorf("State change %d: expected %s, got %s", i, s, got)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	path, received := unixServer(t)
+	e := StartEndpoint(ServerInfo{
+		Network:           "unix",
+		Host:              path,
+		Heartbeat:         &Message{State: STATE_OK, Host: "sender", Service: "heartbeat", Message: "alive"},
+		HeartbeatInterval: 20 * time.Millisecond,
+		FinalHeartbeat:    true,
+	}, 1)
+	time.Sleep(70 * time.Millisecond)
+	e.Close()
+	b := <-received
+	count := len(b) / 720
+	if count < 3 {
+		t.Fatalf("Expected at least 2 heartbeats and a final one, got %d packets", count)
+	}
+	enc := newEncryption(ENCRYPT_NONE, make([]byte, 128), "")
+	for i := 0; i < count; i++ {
+		p, err := decodeDataPacket(b[i*720:(i+1)*720], enc)
+		if err != nil {
+			t.Fatalf("Error decoding packet %d: %s", i, err)
+		}
+		expected := "alive"
+		if i == count-1 {
+			expected = finalHeartbeatOutput
+		}
+		if p.hostName != "sender" || p.serviceDescription != "heartbeat" || p.pluginOutput != expected {
+			t.Errorf("Bad heartbeat %d: %+v", i, p)
+		}
+	}
+}
+
+func TestCoalesceHeartbeat(t *testing.T) {
+	path, received := unixServer(t)
+	now := time.Unix(1000, 0)
+	e := NewEndpoint(ServerInfo{
+		Network:           "unix",
+		Host:              path,
+		Heartbeat:         &Message{State: STATE_OK, Host: "sender", Service: "heartbeat", Message: "alive"},
+		HeartbeatInterval: time.Minute,
+		CoalesceHeartbeat: true,
+		Clock:             func() time.Time { return now },
+	})
+	e.sendHeartbeat("") // nothing sent yet, so this one goes out
+	e.take(1)
+	e.release(&Message{Host: "sender", Service: "disk"})
+	now = now.Add(30 * time.Second)
+	e.sendHeartbeat("") // skipped: real traffic 30s ago
+	e.take(1)
+	e.release(&Message{Host: "other", Service: "disk"})
+	now = now.Add(time.Minute)
+	e.sendHeartbeat("") // sent: the host has been quiet for a minute
+	e.sendHeartbeat(finalHeartbeatOutput)
+	e.disconnect()
+	b := <-received
+	enc := newEncryption(ENCRYPT_NONE, make([]byte, 128), "")
+	var got []string
+	for i := 0; i+720 <= len(b); i += 720 {
+		p, err := decodeDataPacket(b[i:i+720], enc)
+		if err != nil {
+			t.Fatalf("Error decoding packet: %s", err)
+		}
+		got = append(got, p.hostName+"/"+p.serviceDescription)
+	}
+	expected := "[sender/heartbeat sender/disk other/disk sender/heartbeat sender/heartbeat]"
+	if fmt.Sprint(got) != expected {
+		t.Errorf("Expected %s, got %v", expected, got)
+	}
+}
+
+func TestAppKeepalive(t *testing.T) {
+	path, received := unixServer(t)
+	now := time.Unix(1000, 0)
+	e := NewEndpoint(ServerInfo{
+		Network:             "unix",
+		Host:                path,
+		AppKeepalive:        time.Minute,
+		AppKeepaliveMessage: &Message{State: STATE_OK, Host: "sender", Service: "keepalive"},
+		Clock:               func() time.Time { return now },
+	})
+	e.sendKeepalive() // not connected: nothing to keep alive
+	if e.server.conn != nil {
+		t.Fatalf("Keepalive should not connect")
+	}
+	if err := e.connect(); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	now = now.Add(20 * time.Second)
+	e.sendKeepalive() // recently used
+	now = now.Add(20 * time.Second)
+	e.sendKeepalive() // idle for 40s, so it is sent
+	e.sendKeepalive() // just sent
+	e.disconnect()
+	b := <-received
+	if len(b) != 720 {
+		t.Fatalf("Expected one keepalive packet, got %d bytes", len(b))
+	}
+	p, err := decodeDataPacket(b, newEncryption(ENCRYPT_NONE, make([]byte, 128), ""))
+	if err != nil || p.hostName != "sender" || p.serviceDescription != "keepalive" {
+		t.Errorf("Bad keepalive %+v: %v", p, err)
+	}
+}
+
+func TestHostRewriter(t *testing.T) {
+	iv := make([]byte, 128)
+	info := ServerInfo{
+		HostRewriter:    func(host string) string { return strings.TrimSuffix(host, ".internal") },
+		ServiceRewriter: strings.ToUpper,
+	}
+	m := &Message{Host: "web01.internal", Service: "disk"}
+	b, err := CaptureSend(info, iv, 1, m)
+	if err != nil {
+		t.Fatalf("Error capturing send: %s", err)
+	}
+	p, err := decodeDataPacket(b, newEncryption(ENCRYPT_NONE, iv, ""))
+	if err != nil {
+		t.Fatalf("Error decoding packet: %s", err)
+	}
+	if p.hostName != "web01" || p.serviceDescription != "DISK" {
+		t.Errorf("Names not rewritten: %q / %q", p.hostName, p.serviceDescription)
+	}
+	if m.Host != "web01.internal" || m.Service != "disk" {
+		t.Errorf("The message itself was modified: %+v", m)
+	}
+	payload, err := nrdpPayload(info, m)
+	if err != nil || !strings.Contains(string(payload), "<hostname>web01</hostname>") {
+		t.Errorf("NRDP payload not rewritten: %s, %v", payload, err)
+	}
+}
+
+func TestBeforeWrite(t *testing.T) {
+	iv := make([]byte, 128)
+	var seen []int
+	info := ServerInfo{BeforeWrite: func(m *Message, packet []byte) {
+		seen = append(seen, len(packet))
+		packet[0] = 0xff
+		_ = append(packet, 1, 2, 3) // cannot change what is written
+	}}
+	b, err := CaptureSend(info, iv, 1, &Message{Host: "a"}, &Message{Host: "b"})
+	if err != nil {
+		t.Fatalf("Error capturing send: %s", err)
+	}
+	if len(seen) != 2 || seen[0] != 720 || seen[1] != 720 {
+		t.Errorf("Expected two calls with one packet each, got %v", seen)
+	}
+	if len(b) != 2*720 || b[0] != 0xff || b[720] != 0xff {
+		t.Errorf("Expected the two changed packets to be written, got %d bytes", len(b))
+	}
+}
+
+func TestSanitizeOutput(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"plain text", "plain text"},
+		{"line one\nline two\r\nline three\rend", `line one\nline two\nline three\nend`},
+		{"load=1 | load=1;5;10", "load=1 ¦ load=1;5;10"},
+		{"tab\there\x00nul\x7f", "tab here nul "},
+		{"ünïcode", "ünïcode"},
+	}
+	for _, test := range tests {
+		if out := sanitizeOutput(test.in); out != test.out {
+			t.Errorf("sanitizeOutput(%q): expected %q, got %q", test.in, test.out, out)
+		}
+	}
+	iv := make([]byte, 128)
+	m := &Message{Host: "host", Service: "service", Message: "a|b\nc"}
+	for _, sanitize := range []bool{false, true} {
+		b, err := CaptureSend(ServerInfo{SanitizeOutput: sanitize}, iv, 1, m)
+		if err != nil {
+			t.Fatalf("Error capturing send: %s", err)
+		}
+		p, err := decodeDataPacket(b, newEncryption(ENCRYPT_NONE, iv, ""))
+		if err != nil {
+			t.Fatalf("Error decoding packet: %s", err)
+		}
+		expected := m.Message
+		if sanitize {
+			expected = `a¦b\nc`
+		}
+		if p.pluginOutput != expected {
+			t.Errorf("SanitizeOutput %v: expected %q, got %q", sanitize, expected, p.pluginOutput)
+		}
+	}
+}
+
+func TestMinReconnectInterval(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var sleeps []time.Duration
+	e := StartEndpoint(ServerInfo{
+		Network:              "unix",
+		Host:                 t.TempDir() + "/missing.sock",
+		MinReconnectInterval: time.Second,
+		Clock:                func() time.Time { return now },
+		Sleep: func(d time.Duration) {
+			sleeps = append(sleeps, d)
+			now = now.Add(d)
+		},
+	}, 3)
+	for i := 0; i < 3; i++ {
+		e.Submit(&Message{Host: "host"})
+	}
+	if err := e.Close(); err == nil {
+		t.Fatalf("Expected a connection error")
+	}
+	if n := e.Handshakes(); n != 3 {
+		t.Errorf("Expected 3 handshakes, got %d", n)
+	}
+	if len(sleeps) != 2 || sleeps[0] != time.Second || sleeps[1] != time.Second {
+		t.Errorf("Expected two waits of 1s between reconnects, got %v", sleeps)
+	}
+}
+
+func TestAfter(t *testing.T) {
+	path, received := unixServer(t)
+	fire := make(chan time.Time)
+	e := StartEndpoint(ServerInfo{
+		Network:           "unix",
+		Host:              path,
+		Heartbeat:         &Message{Host: "host", Service: "heartbeat"},
+		HeartbeatInterval: time.Hour,
+		After:             func(time.Duration) <-chan time.Time { return fire },
+	}, 1)
+	// the hour-long heartbeat interval passes twice without waiting
+	fire <- time.Time{}
+	fire <- time.Time{}
+	deadline := time.Now().Add(2 * time.Second)
+	for e.Report().Delivered < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	e.Close()
+	if b := <-received; len(b) != 2*720 {
+		t.Errorf("Expected 2 heartbeats, got %d bytes", len(b))
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	path, received := unixServer(t)
+	states := make(chan ConnState, 20)
+	messages := make(chan *Message, 10)
+	// a deadline in the past makes every send of the message fail
+	poisonedStatus, goodStatus := make(chan error, 1), make(chan error, 1)
+	poisoned := &Message{Host: "poisoned", Deadline: time.Unix(1, 0), Status: poisonedStatus}
+	good := &Message{Host: "good", Status: goodStatus}
+	messages <- poisoned
+	messages <- good
+	close(messages)
+	RunEndpoint(ServerInfo{Network: "unix", Host: path, MaxRetries: 2, StateChanges: states}, nil, messages)
+	err := <-poisonedStatus
+	if !errors.Is(err, ErrRetriesExhausted) {
+		t.Errorf("Expected ErrRetriesExhausted, got %v", err)
+	}
+	if err := <-goodStatus; err != nil {
+		t.Errorf("Error sending the message after the poisoned one: %s", err)
+	}
+	close(states)
+	connects := 0
+	for s := range states {
+		if s == Connected {
+			connects++
+		}
+	}
+	// one connection for each attempt at the poisoned message, then one for the good one
+	if connects != 4 {
+		t.Errorf("Expected 4 connections, got %d", connects)
+	}
+	total := 0
+	for i := 0; i < connects; i++ {
+		total += len(<-received)
+	}
+	if total != 720 {
+		t.Errorf("Expected only the good message to be written, got %d bytes", total)
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	iv := make([]byte, 128)
+	m := &Message{Host: "host", Service: "service", Message: "bad \xff\xfe byte"}
+	_, err := CaptureSend(ServerInfo{}, iv, 1, m)
+	if !errors.Is(err, ErrInvalidUTF8) {
+		t.Errorf("Expected ErrInvalidUTF8, got %v", err)
+	}
+	b, err := CaptureSend(ServerInfo{ReplaceInvalidUTF8: true}, iv, 1, m)
+	if err != nil {
+		t.Fatalf("Error capturing send: %s", err)
+	}
+	p, err := decodeDataPacket(b, newEncryption(ENCRYPT_NONE, iv, ""))
+	if err != nil {
+		t.Fatalf("Error decoding packet: %s", err)
+	}
+	if p.pluginOutput != "bad � byte" {
+		t.Errorf("Expected the invalid bytes to be replaced, got %q", p.pluginOutput)
+	}
+
+	// fields too long for the packet are cut between runes
+	m = &Message{Host: strings.Repeat("é", 40), Service: strings.Repeat("é", 100), Message: strings.Repeat("é", 300)}
+	b, err = CaptureSend(ServerInfo{}, iv, 1, m)
+	if err != nil {
+		t.Fatalf("Error capturing send: %s", err)
+	}
+	p, err = decodeDataPacket(b, newEncryption(ENCRYPT_NONE, iv, ""))
+	if err != nil {
+		t.Fatalf("Error decoding packet: %s", err)
+	}
+	for _, field := range []struct {
+		name, value string
+		length      int
+	}{
+		{"host", p.hostName, HostNameLength - 2},
+		{"service", p.serviceDescription, ServiceLength - 2},
+		{"output", p.pluginOutput, PluginOutputLength - 2},
+	} {
+		if !utf8.ValidString(field.value) || len(field.value) != field.length {
+			t.Errorf("Bad truncated %s: %d bytes %q", field.name, len(field.value), field.value)
+		}
+	}
+}
+
+func TestMinInterval(t *testing.T) {
+	path, received := unixServer(t)
+	messages := make(chan *Message)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		RunEndpoint(ServerInfo{Network: "unix", Host: path, MinInterval: 100 * time.Millisecond}, nil, messages)
+	}()
+	statuses := make([]chan error, 4)
+	for i := range statuses {
+		statuses[i] = make(chan error, 1)
+	}
+	start := time.Now()
+	messages <- &Message{Host: "host", Service: "flapping", Message: "1", Status: statuses[0]}
+	messages <- &Message{Host: "host", Service: "flapping", Message: "2", Status: statuses[1]}
+	messages <- &Message{Host: "host", Service: "flapping", Message: "3", Status: statuses[2]}
+	// other services are not held back
+	messages <- &Message{Host: "host", Service: "other", Message: "4", Status: statuses[3]}
+	if err := <-statuses[0]; err != nil {
+		t.Errorf("Error sending the first message: %s", err)
+	}
+	if err := <-statuses[1]; err != ErrDebounced {
+		t.Errorf("Expected ErrDebounced for the replaced message, got %v", err)
+	}
+	if err := <-statuses[3]; err != nil {
+		t.Errorf("Error sending the other service: %s", err)
+	}
+	if err := <-statuses[2]; err != nil {
+		t.Errorf("Error sending the latest message: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Latest message was sent after %s, before the minimum interval", elapsed)
+	}
+	close(messages)
+	<-done
+	enc := newEncryption(ENCRYPT_NONE, make([]byte, 128), "")
+	b := <-received
+	var outputs []string
+	for i := 0; i+720 <= len(b); i += 720 {
+		p, err := decodeDataPacket(b[i:i+720], enc)
+		if err != nil {
+			t.Fatalf("Error decoding packet: %s", err)
+		}
+		outputs = append(outputs, p.pluginOutput)
+	}
+	if strings.Join(outputs, ",") != "1,4,3" {
+		t.Errorf("Expected outputs 1,4,3, got %v", outputs)
+	}
+}
+
+func TestSafeServer(t *testing.T) {
+	path, received := unixServer(t)
+	var s SafeServer
+	if err := s.Connect(ServerInfo{Network: "unix", Host: path}); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := s.Send(&Message{Host: "host", Message: fmt.Sprint(i)}); err != nil {
+				t.Errorf("Error sending %d: %s", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	s.Close()
+	b := <-received
+	if len(b) != 10*720 {
+		t.Fatalf("Expected 10 packets, got %d bytes", len(b))
+	}
+	enc := newEncryption(ENCRYPT_NONE, make([]byte, 128), "")
+	for i := 0; i < 10; i++ {
+		if _, err := decodeDataPacket(b[i*720:(i+1)*720], enc); err != nil {
+			t.Errorf("Packet %d is corrupt: %s", i, err)
+		}
+	}
+}
+
+func TestServerInfoValidate(t *testing.T) {
+	valid := []ServerInfo{
+		{Port: "5667"},
+		{Host: "nagios", Port: "5667", EncryptionMethod: ENCRYPT_XOR, Password: "secret", Timeout: time.Second},
+		{Network: "unix", Host: "/run/nsca.sock"},
+		{DryRun: true},
+		{Transport: NRDP, Host: "https://nagios.example.com/nrdp/", Password: "token"},
+	}
+	for _, info := range valid {
+		if err := info.Validate(); err != nil {
+			t.Errorf("%v: unexpected error %s", info, err)
+		}
+	}
+	invalid := []struct {
+		info ServerInfo
+		err  error
+	}{
+		{ServerInfo{Host: "nagios"}, ErrInvalidConfig},
+		{ServerInfo{Host: "nagios", Port: "nsca"}, ErrInvalidConfig},
+		{ServerInfo{Host: "nagios", Port: "70000"}, ErrInvalidConfig},
+		{ServerInfo{Network: "sctp", Port: "5667"}, ErrInvalidConfig},
+		{ServerInfo{Network: "unix"}, ErrInvalidConfig},
+		{ServerInfo{Port: "5667", EncryptionMethod: ENCRYPT_CAST128, Password: "secret"}, ErrEncryptionUnsupported},
+		{ServerInfo{Port: "5667", EncryptionMethod: ENCRYPT_DES}, ErrEmptyPassword},
+		{ServerInfo{Port: "5667", Password: "secret", StrictConfig: true}, ErrInsecureConfig},
+		{ServerInfo{Port: "5667", Timeout: -time.Second}, ErrInvalidConfig},
+		{ServerInfo{Port: "5667", MaxRetries: -1}, ErrInvalidConfig},
+		{ServerInfo{Port: "5667", HeartbeatInterval: time.Minute}, ErrInvalidConfig},
+		{ServerInfo{Transport: NRDP, Host: "nagios", Password: "token"}, ErrInvalidConfig},
+	}
+	for _, test := range invalid {
+		if err := test.info.Validate(); !errors.Is(err, test.err) {
+			t.Errorf("%v: expected %v, got %v", test.info, test.err, err)
+		}
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	valid := &Message{State: STATE_CRITICAL, Host: "host", Service: "service", Message: "output"}
+	if err := ValidateBatch([]*Message{valid, valid}); err != nil {
+		t.Errorf("Valid batch rejected: %s", err)
+	}
+	tests := []struct {
+		m      *Message
+		reason error
+	}{
+		{nil, ErrNilMessage},
+		{&Message{State: 4, Host: "host"}, ErrInvalidState},
+		{&Message{State: -1, Host: "host"}, ErrInvalidState},
+		{&Message{Host: strings.Repeat("h", HostNameLength)}, ErrFieldTooLong},
+		{&Message{Host: "host", Service: strings.Repeat("s", ServiceLength)}, ErrFieldTooLong},
+		{&Message{Host: "host", Message: strings.Repeat("o", PluginOutputLength)}, ErrFieldTooLong},
+	}
+	for _, test := range tests {
+		err := ValidateBatch([]*Message{valid, test.m, valid})
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) || batchErr.Index != 1 || !errors.Is(err, test.reason) {
+			t.Errorf("Expected %v at index 1, got %v", test.reason, err)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	iv := make([]byte, 128)
+	rand.Read(iv)
+	captured := make(chan []byte, 1)
+	go func() {
+		defer server.Close()
+		init := append(append([]byte{}, iv...), 0, 0, 0x04, 0xd2)
+		server.Write(init)
+		b, _ := io.ReadAll(server)
+		captured <- b
+	}()
+	info := ServerInfo{EncryptionMethod: ENCRYPT_XOR, Password: "password", Timeout: time.Second}
+	n := new(NSCAServer)
+	if err := n.Handshake(client, info); err != nil {
+		t.Fatalf("Error in handshake: %s", err)
+	}
+	if err := n.Send(&Message{Host: "host", Message: "piped"}); err != nil {
+		t.Fatalf("Error sending: %s", err)
+	}
+	n.Close()
+	p, err := decodeDataPacket(<-captured, newEncryption(info.EncryptionMethod, iv, info.Password))
+	if err != nil {
+		t.Fatalf("Error decoding packet: %s", err)
+	}
+	if p.timestamp != 1234 || p.hostName != "host" || p.pluginOutput != "piped" {
+		t.Errorf("Bad packet: %+v", p)
+	}
+}
+
+func TestTruncationMarker(t *testing.T) {
+	const marker = "...[truncated]"
+	max := PluginOutputLength - 1
+	if out := truncateOutput("short", marker, max); out != "short" {
+		t.Errorf("Short output changed: %q", out)
+	}
+	out := truncateOutput(strings.Repeat("x", 1000), marker, max)
+	if len(out) != max || !strings.HasSuffix(out, marker) {
+		t.Errorf("Bad truncated output: %d bytes, %q", len(out), out[len(out)-20:])
+	}
+	// a multi-byte character is not split
+	out = truncateOutput(strings.Repeat("é", 600), marker, max)
+	if !utf8.ValidString(out) || len(out) > max || !strings.HasSuffix(out, marker) {
+		t.Errorf("Bad truncated UTF-8 output: %d bytes", len(out))
+	}
+	if out := truncateOutput(strings.Repeat("x", 20), marker, 10); out != marker[:10] {
+		t.Errorf("Expected the marker cut to fit, got %q", out)
+	}
+	if out := truncateOutput(strings.Repeat("x", 20), "…[cut]", 2); out != "" {
+		t.Errorf("Expected a multi-byte marker cut between runes, got %q", out)
+	}
+	if out := truncateOutput(strings.Repeat("x", 20), "…[cut]", 3); out != "…" {
+		t.Errorf("Expected a multi-byte marker cut between runes, got %q", out)
+	}
+
+	iv := make([]byte, 128)
+	b, err := CaptureSend(ServerInfo{TruncationMarker: marker}, iv, 1,
+		&Message{Host: "host", Message: strings.Repeat("x", 1000)})
+	if err != nil {
+		t.Fatalf("Error capturing send: %s", err)
+	}
+	p, err := decodeDataPacket(b, newEncryption(ENCRYPT_NONE, iv, ""))
+	if err != nil {
+		t.Fatalf("Error decoding packet: %s", err)
+	}
+	if !strings.HasSuffix(p.pluginOutput, marker) {
+		t.Errorf("Sent output does not end with the marker")
+	}
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	iv := make([]byte, 128)
+	enc := newEncryption(ENCRYPT_NONE, iv, "")
+	m := &Message{Host: "host", Message: strings.Repeat("x", 300)}
+	for _, test := range []struct {
+		info    ServerInfo
+		outputs []string
+	}{
+		{ServerInfo{MaxOutputBytes: 100}, []string{strings.Repeat("x", 100)}},
+		{ServerInfo{MaxOutputBytes: 100, TruncationMarker: "..."}, []string{strings.Repeat("x", 97) + "..."}},
+		{ServerInfo{MaxOutputBytes: 5000}, []string{strings.Repeat("x", 300)}},
+		{ServerInfo{MaxOutputBytes: 200, AllowChunkedOutput: true},
+			[]string{"[1/2] " + strings.Repeat("x", 194), "[2/2] " + strings.Repeat("x", 106)}},
+	} {
+		b, err := CaptureSend(test.info, iv, 1, m)
+		if err != nil {
+			t.Fatalf("Error capturing send: %s", err)
+		}
+		if len(b) != len(test.outputs)*720 || m.WireSize(test.info) != len(b) {
+			t.Fatalf("%+v: expected %d packets, got %d bytes", test.info, len(test.outputs), len(b))
+		}
+		for i, expected := range test.outputs {
+			p, err := decodeDataPacket(b[i*720:(i+1)*720], enc)
+			if err != nil || p.pluginOutput != expected {
+				t.Errorf("MaxOutputBytes %d, packet %d: got %d bytes, %v", test.info.MaxOutputBytes, i, len(p.pluginOutput), err)
+			}
+		}
+	}
+	if out := chunkOutput(strings.Repeat("x", 20), 4); len(out) != 1 || out[0] != "xxxx" {
+		t.Errorf("Expected a limit too small for chunk markers to truncate, got %q", out)
+	}
+}
+
+func TestNewServerFromInitPacket(t *testing.T) {
+	iv := make([]byte, 128)
+	rand.Read(iv)
+	init := append(append([]byte{}, iv...), 0, 0, 0x04, 0xd2)
+	sink := new(bytes.Buffer)
+	info := ServerInfo{EncryptionMethod: ENCRYPT_3DES, Password: "password", DryRunOutput: sink}
+	n, err := NewServerFromInitPacket(info, init)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+	if err := n.Send(&Message{State: STATE_WARNING, Host: "host", Message: "replayed"}); err != nil {
+		t.Fatalf("Error sending: %s", err)
+	}
+	p, err := decodeDataPacket(sink.Bytes(), newEncryption(info.EncryptionMethod, iv, info.Password))
+	if err != nil {
+		t.Fatalf("Error decoding packet: %s", err)
+	}
+	if p.timestamp != 1234 || p.returnCode != STATE_WARNING || p.pluginOutput != "replayed" {
+		t.Errorf("Bad packet: %+v", p)
+	}
+	if _, err := NewServerFromInitPacket(info, init[:100]); !errors.Is(err, ErrBadInitPacket) {
+		t.Errorf("Expected ErrBadInitPacket for a short packet, got %v", err)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("TEST_NSCA_HOST", "nagios.example.com")
+	t.Setenv("TEST_NSCA_PORT", "5667")
+	t.Setenv("TEST_NSCA_ENCRYPTION", "rijndael-128")
+	t.Setenv("TEST_NSCA_PASSWORD", "secret")
+	t.Setenv("TEST_NSCA_TIMEOUT", "10s")
+	info, err := ConfigFromEnv("TEST_NSCA")
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+	if info.Host != "nagios.example.com" || info.Port != "5667" || info.EncryptionMethod != ENCRYPT_RIJNDAEL128 ||
+		info.Password != "secret" || info.Timeout != 10*time.Second {
+		t.Errorf("Bad config: %+v", info)
+	}
+	t.Setenv("TEST_NSCA_PASSWORD", "")
+	if _, err := ConfigFromEnv("TEST_NSCA"); err == nil || !strings.Contains(err.Error(), "TEST_NSCA_PASSWORD") {
+		t.Errorf("Expected an error naming the password variable, got %v", err)
+	}
+	t.Setenv("TEST_NSCA_ENCRYPTION", "none")
+	t.Setenv("TEST_NSCA_TIMEOUT", "soon")
+	if _, err := ConfigFromEnv("TEST_NSCA"); err == nil || !strings.Contains(err.Error(), "TEST_NSCA_TIMEOUT") {
+		t.Errorf("Expected an error naming the timeout variable, got %v", err)
+	}
+	if _, err := ConfigFromEnv("TEST_MISSING"); err == nil || !strings.Contains(err.Error(), "TEST_MISSING_HOST") {
+		t.Errorf("Expected an error naming the host variable, got %v", err)
+	}
+}
+
+func TestWireSize(t *testing.T) {
+	short := &Message{Host: "host", Message: "output"}
+	long := &Message{Host: "host", Message: strings.Repeat("x", 1200)}
+	if size := short.WireSize(ServerInfo{}); size != DataPacketSize {
+		t.Errorf("Expected %d bytes, got %d", DataPacketSize, size)
+	}
+	if size := long.WireSize(ServerInfo{}); size != DataPacketSize {
+		t.Errorf("Expected truncated output to take one packet, got %d bytes", size)
+	}
+	info := ServerInfo{AllowChunkedOutput: true}
+	b, err := CaptureSend(info, make([]byte, 128), 1, long)
+	if err != nil {
+		t.Fatalf("Error capturing send: %s", err)
+	}
+	if size := long.WireSize(info); size != len(b) {
+		t.Errorf("Expected %d bytes for chunked output, got %d", len(b), size)
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	path, _ := unixServer(t)
+	d, err := Diagnose(ServerInfo{Network: "unix", Host: path, EncryptionMethod: ENCRYPT_RIJNDAEL128, Password: "password"})
+	if err != nil {
+		t.Fatalf("Error diagnosing: %s", err)
+	}
+	// the fake server sends a zero timestamp
+	if d.RemoteAddr != path || d.IVLength != 16 || d.Cipher != "rijndael-128" || d.ServerTimestamp.Unix() != 0 ||
+		d.ConnectLatency <= 0 || d.HandshakeLatency <= 0 {
+		t.Errorf("Bad diagnostics: %+v", d)
+	}
+	d, err = Diagnose(ServerInfo{Network: "unix", Host: path + ".missing"})
+	if err == nil || d.RemoteAddr != "" {
+		t.Errorf("Expected a connect error, got %v, %+v", err, d)
+	}
+}
+
+func TestUseClientTimestamp(t *testing.T) {
+	iv := make([]byte, 128)
+	m := &Message{Host: "host"}
+	clock := func() time.Time { return time.Unix(5000, 0) }
+	for _, client := range []bool{false, true} {
+		b, err := CaptureSend(ServerInfo{UseClientTimestamp: client, Clock: clock}, iv, 1234, m)
+		if err != nil {
+			t.Fatalf("Error capturing send: %s", err)
+		}
+		p, err := decodeDataPacket(b, newEncryption(ENCRYPT_NONE, iv, ""))
+		if err != nil {
+			t.Fatalf("Error decoding packet: %s", err)
+		}
+		expected := uint32(1234)
+		if client {
+			expected = 5000
+		}
+		if p.timestamp != expected {
+			t.Errorf("UseClientTimestamp %v: expected timestamp %d, got %d", client, expected, p.timestamp)
+		}
+	}
+}
+
+func TestSendBatchTimestamp(t *testing.T) {
+	now := int64(5000)
+	clock := func() time.Time {
+		now++ // every reading of the clock is a second later
+		return time.Unix(now, 0)
+	}
+	info := ServerInfo{UseClientTimestamp: true, Clock: clock}
+	n, iv, captured := pipeServer(t, info)
+	err := n.SendBatch([]*Message{{Host: "a"}, {Host: "b"}, {Host: "c"}})
+	if err != nil {
+		t.Fatalf("Error sending batch: %s", err)
+	}
+	n.Close()
+	b := <-captured
+	enc := newEncryption(ENCRYPT_NONE, iv, "")
+	var first uint32
+	for i := 0; i < 3; i++ {
+		p, err := decodeDataPacket(b[i*720:(i+1)*720], enc)
+		if err != nil {
+			t.Fatalf("Error decoding packet %d: %s", i, err)
+		}
+		if i == 0 {
+			first = p.timestamp
+		} else if p.timestamp != first {
+			t.Errorf("Packet %d has timestamp %d, expected %d", i, p.timestamp, first)
+		}
+	}
+}
+
+func TestContextErrors(t *testing.T) {
+	// a server that accepts but never sends its initialization packet
+	path := t.TempDir() + "/nsca.sock"
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	err = Send(ServerInfo{Network: "unix", Host: path, OverallTimeout: 50 * time.Millisecond}, &Message{Host: "host"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded from Send, got %v", err)
+	}
+	err = Send(ServerInfo{Network: "unix", Host: path, Timeout: 50 * time.Millisecond}, &Message{Host: "host"})
+	if err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("A network timeout should not look like a context deadline, got %v", err)
+	}
+
+	// a server that never reads, so the write waits for the message's deadline
+	client, server := net.Pipe()
+	defer server.Close()
+	go server.Write(make([]byte, 132))
+	n := new(NSCAServer)
+	if err := n.handshake(client, ServerInfo{}); err != nil {
+		t.Fatalf("Handshake failed: %s", err)
+	}
+	defer n.Close()
+	err = n.Send(&Message{Host: "host", Deadline: time.Now().Add(20 * time.Millisecond)})
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected a wrapped context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestMessageDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		server.Write(make([]byte, 132))
+		b, _ := io.ReadAll(server)
+		received <- b
+	}()
+	n := new(NSCAServer)
+	if err := n.handshake(client, ServerInfo{}); err != nil {
+		t.Fatalf("Handshake failed: %s", err)
+	}
+	err := n.Send(&Message{Host: "late", Deadline: time.Unix(1, 0)})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded for a past deadline, got %v", err)
+	}
+	// the message's deadline does not apply to the next one
+	if err := n.Send(&Message{Host: "next"}); err != nil {
+		t.Errorf("Error sending after a message deadline: %s", err)
+	}
+	if err := n.SendBatch([]*Message{{Host: "batch"}}); err != nil {
+		t.Errorf("Error sending a batch after a message deadline: %s", err)
+	}
+	n.Close()
+	if b := <-received; len(b) != 2*720 {
+		t.Errorf("Expected 2 packets, got %d bytes", len(b))
+	}
+}
+
+func TestVerifyBeforeSend(t *testing.T) {
+	path := t.TempDir() + "/nsca.sock"
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	restart := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(make([]byte, 132))
+		// the daemon restarts, closing the connection
+		<-restart
+		conn.Close()
+	}()
+	n := new(NSCAServer)
+	defer n.Close()
+	if err := n.Connect(ServerInfo{Network: "unix", Host: path, VerifyBeforeSend: true}); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	if !n.Alive() {
+		t.Errorf("Open connection reported as not alive")
+	}
+	if err := n.Send(&Message{Host: "host"}); err != nil {
+		t.Errorf("Error sending on the open connection: %s", err)
+	}
+	close(restart)
+	deadline := time.Now().Add(time.Second)
+	for n.Alive() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n.Alive() {
+		t.Fatalf("Closed connection still reported as alive")
+	}
+	if err := n.Send(&Message{Host: "host"}); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("Expected ErrConnectionClosed, got %v", err)
+	}
+	dry := new(NSCAServer)
+	if err := dry.Connect(ServerInfo{DryRun: true}); err != nil || !dry.Alive() {
+		t.Errorf("Dry run connection not alive: %v", err)
+	}
+}
+
+func TestParallelDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write(make([]byte, 132))
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	// a port nothing listens on
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	downAddr := down.Addr().String()
+	down.Close()
+
+	conn, err := raceDial(context.Background(), &net.Dialer{}, "tcp", []string{downAddr, l.Addr().String()})
+	if err != nil {
+		t.Fatalf("Error racing dials: %s", err)
+	}
+	if conn.RemoteAddr().String() != l.Addr().String() {
+		t.Errorf("Connected to %s instead of the live server", conn.RemoteAddr())
+	}
+	conn.Close()
+	if _, err := raceDial(context.Background(), &net.Dialer{}, "tcp", []string{downAddr, downAddr}); err == nil {
+		t.Errorf("Expected an error when every address is down")
+	}
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	err = Ping(ServerInfo{Network: "tcp4", Host: "localhost", Port: port, ParallelDial: true, Timeout: time.Second})
+	if err != nil {
+		t.Errorf("Error connecting with ParallelDial: %s", err)
+	}
+}
+
+func TestRegisterTransport(t *testing.T) {
+	var dialed string
+	captured := make(chan []byte, 1)
+	RegisterTransport("memory", func(ctx context.Context, addr string) (net.Conn, error) {
+		dialed = addr
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			server.Write(make([]byte, 132))
+			b, _ := io.ReadAll(server)
+			captured <- b
+		}()
+		return client, nil
+	})
+	defer RegisterTransport("memory", nil)
+	var n NSCAServer
+	err := n.Connect(ServerInfo{Network: "memory", Host: "example", Port: "5667"})
+	if err != nil {
+		t.Fatalf("Connect over registered transport failed: %s", err)
+	}
+	if dialed != "example:5667" {
+		t.Errorf("Transport dialed %q", dialed)
+	}
+	err = n.Send(&Message{State: STATE_OK, Host: "host", Message: "via memory"})
+	if err != nil {
+		t.Fatalf("Send failed: %s", err)
+	}
+	n.Close()
+	if b := <-captured; len(b) != 720 {
+		t.Errorf("Expected one packet, got %d bytes", len(b))
+	}
+
+	RegisterTransport("memory", nil)
+	if err := n.Connect(ServerInfo{Network: "memory", Host: "example", Port: "5667"}); err == nil {
+		n.Close()
+		t.Errorf("Connect should fail once the transport is removed")
+	}
+}
+
+func TestNewMessage(t *testing.T) {
+	target := CheckTarget{Host: "web01", Service: "disk"}
+	m := NewMessage(target, STATE_CRITICAL, "disk full")
+	if m.Host != "web01" || m.Service != "disk" || m.State != STATE_CRITICAL || m.Message != "disk full" {
+		t.Errorf("Bad message: %+v", m)
+	}
+	if m.Target() != target {
+		t.Errorf("Expected target %+v, got %+v", target, m.Target())
+	}
+}
+
+func TestStrictConfig(t *testing.T) {
+	logged := new(bytes.Buffer)
+	info := ServerInfo{DryRun: true, Password: "secret", Logger: log.New(logged, "", 0)}
+	n := new(NSCAServer)
+	if err := n.Connect(info); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	n.Close()
+	if !strings.Contains(logged.String(), "unencrypted") {
+		t.Errorf("Expected a warning about the missing encryption, got %q", logged.String())
+	}
+	info.StrictConfig = true
+	if err := n.Connect(info); err != ErrInsecureConfig {
+		t.Errorf("Expected ErrInsecureConfig, got %v", err)
+	}
+	info.EncryptionMethod = ENCRYPT_XOR
+	if err := n.Connect(info); err != nil {
+		t.Errorf("Error connecting with encryption: %s", err)
+	}
+	n.Close()
+}
+
+func TestParseURL(t *testing.T) {
+	info, err := ParseURL("nsca://:p%40ss@nagios.example.com:5667?encryption=aes256&timeout=10s")
+	if err != nil {
+		t.Fatalf("Error parsing URL: %s", err)
+	}
+	if info.Host != "nagios.example.com" || info.Port != "5667" || info.Password != "p@ss" ||
+		info.EncryptionMethod != ENCRYPT_RIJNDAEL256 || info.Timeout != 10*time.Second || info.Network != "" {
+		t.Errorf("Bad config: %+v", info)
+	}
+	info, err = ParseURL("nsca://[::1]:5667?network=tcp6")
+	if err != nil || info.Host != "::1" || info.Network != "tcp6" || info.Password != "" {
+		t.Errorf("Bad IPv6 config: %+v, %v", info, err)
+	}
+	for _, s := range []string{
+		"http://host:5667",
+		"nsca://host",
+		"nsca://host:5667?encryption=rot13",
+		"nsca://host:5667?timeout=soon",
+		"nsca://host:5667?encrypton=aes256",
+		"nsca://host:5667?network=unix",
+	} {
+		if _, err := ParseURL(s); err == nil {
+			t.Errorf("ParseURL(%q) did not fail", s)
+		}
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+	file := t.TempDir() + "/password"
+	if err := os.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("Could not write password file: %s", err)
+	}
+	iv := make([]byte, 128)
+	rand.Read(iv)
+	info := ServerInfo{EncryptionMethod: ENCRYPT_RIJNDAEL128, Password: "inline", PasswordFile: file}
+	b, err := CaptureSend(info, iv, 1, &Message{Host: "host"})
+	if err != nil {
+		t.Fatalf("Error capturing send: %s", err)
+	}
+	if _, err := decodeDataPacket(b, newEncryption(ENCRYPT_RIJNDAEL128, iv, "from-file")); err != nil {
+		t.Errorf("Packet was not encrypted with the password from the file: %s", err)
+	}
+
+	n := new(NSCAServer)
+	if err := n.Connect(ServerInfo{DryRun: true, EncryptionMethod: ENCRYPT_XOR, PasswordFile: file}); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	enc := n.encryption
+	n.Close()
+	if !bytes.Equal(enc.password, make([]byte, len("from-file"))) {
+		t.Errorf("Password was not wiped on Close")
+	}
+
+	info.PasswordFile = file + ".missing"
+	if _, err := CaptureSend(info, iv, 1, &Message{Host: "host"}); err == nil {
+		t.Errorf("Expected an error for a missing password file")
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	path, _ := unixServer(t)
+	var calls []int
+	info := ServerInfo{Network: "unix", Host: path, ShouldRetry: func(err error, retry int) bool {
+		calls = append(calls, retry)
+		return retry < 3
+	}}
+	messages := make(chan *Message, 2)
+	status := make(chan error, 2)
+	messages <- &Message{Host: "host", Deadline: time.Unix(1, 0), Status: status}
+	close(messages)
+	RunEndpoint(info, nil, messages)
+	if err := <-status; !errors.Is(err, ErrRetriesExhausted) {
+		t.Errorf("Expected ErrRetriesExhausted, got %v", err)
+	}
+	if fmt.Sprint(calls) != "[1 2 3]" {
+		t.Errorf("Expected ShouldRetry to be asked about retries 1 to 3, got %v", calls)
+	}
+
+	// the default policy does not retry a message that can never be encoded
+	if DefaultShouldRetry(fmt.Errorf("send: %w", ErrInvalidUTF8), 1) || !DefaultShouldRetry(ErrConnectionClosed, 1) {
+		t.Errorf("Bad default retry policy")
+	}
+	messages = make(chan *Message, 1)
+	messages <- &Message{Host: "host", Message: "\xff", Status: status}
+	close(messages)
+	RunEndpoint(ServerInfo{Network: "unix", Host: path, MaxRetries: 3}, nil, messages)
+	if err := <-status; !errors.Is(err, ErrInvalidUTF8) || errors.Is(err, ErrRetriesExhausted) {
+		t.Errorf("Expected ErrInvalidUTF8 without retries, got %v", err)
+	}
+}
+
+func TestConfirmTCPAck(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ConfirmTCPAck is only supported on Linux")
+	}
+	path, _ := unixServer(t)
+	n := new(NSCAServer)
+	defer n.Close()
+	if err := n.Connect(ServerInfo{Network: "unix", Host: path, ConfirmTCPAck: true, Timeout: time.Second}); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	if err := n.Send(&Message{Host: "host"}); err != nil {
+		t.Errorf("Error sending to a server that reads: %s", err)
+	}
+
+	// a server that never reads what is written
+	stuck := t.TempDir() + "/stuck.sock"
+	l, err := net.Listen("unix", stuck)
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(make([]byte, 132))
+		time.Sleep(time.Second)
+	}()
+	if err := n.Connect(ServerInfo{Network: "unix", Host: stuck, ConfirmTCPAck: true, Timeout: 50 * time.Millisecond}); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	if err := n.Send(&Message{Host: "host"}); !errors.Is(err, ErrNotAcknowledged) {
+		t.Errorf("Expected ErrNotAcknowledged, got %v", err)
+	}
+}
+
+func TestServerInfoString(t *testing.T) {
+	info := ServerInfo{Host: "nagios.example.com", Port: "5667", EncryptionMethod: ENCRYPT_XOR, Password: "hunter2"}
+	s := info.String()
+	if strings.Contains(s, "hunter2") || !strings.Contains(s, "Password:****") ||
+		!strings.Contains(s, "Host:nagios.example.com") || !strings.Contains(s, "Port:5667") {
+		t.Errorf("Bad redacted config: %s", s)
+	}
+	if fmt.Sprint(info) != s || info.Password != "hunter2" {
+		t.Errorf("Redacting changed the original config")
+	}
+	if r := (ServerInfo{}).Redacted(); r.Password != "" {
+		t.Errorf("Empty password redacted to %q", r.Password)
+	}
+}
+
+func TestSidecar(t *testing.T) {
+	upstream, received := unixServer(t)
+	path := t.TempDir() + "/sidecar.sock"
+	s, err := StartSidecarServer(path, ServerInfo{Network: "unix", Host: upstream}, 10)
+	if err != nil {
+		t.Fatalf("Error starting sidecar: %s", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		c := NewSidecarClient(path)
+		defer c.Close()
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := c.Send(&Message{State: STATE_WARNING, Host: host, Service: "svc", Message: "out"}); err != nil {
+					t.Errorf("Error sending through sidecar: %s", err)
+				}
+			}
+		}(fmt.Sprint("host", i))
+	}
+	wg.Wait()
+	if err := s.Close(); err != nil {
+		t.Fatalf("Error closing sidecar: %s", err)
+	}
+	// every message went over the one upstream connection
+	b := <-received
+	if len(b) != 10*720 {
+		t.Fatalf("Expected 10 packets on one connection, got %d bytes", len(b))
+	}
+	enc := newEncryption(ENCRYPT_NONE, make([]byte, 128), "")
+	hosts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		p, err := decodeDataPacket(b[i*720:(i+1)*720], enc)
+		if err != nil {
+			t.Fatalf("Error decoding packet %d: %s", i, err)
+		}
+		if p.returnCode != STATE_WARNING || p.serviceDescription != "svc" || p.pluginOutput != "out" {
+			t.Errorf("Bad packet %d: %+v", i, p)
+		}
+		hosts[p.hostName]++
+	}
+	if hosts["host0"] != 5 || hosts["host1"] != 5 {
+		t.Errorf("Bad hosts: %v", hosts)
+	}
+	if err := NewSidecarClient(path).Send(&Message{Host: "late"}); err == nil {
+		t.Errorf("Expected an error sending to a closed sidecar")
+	}
+}
+
+func TestEndpointPause(t *testing.T) {
+	path, received := unixServer(t)
+	e := StartEndpoint(ServerInfo{Network: "unix", Host: path}, 10)
+	e.Pause()
+	var statuses []chan error
+	for i := 0; i < 3; i++ {
+		status := make(chan error, 1)
+		statuses = append(statuses, status)
+		if err := e.Submit(&Message{Host: fmt.Sprint("host", i), Status: status}); err != nil {
+			t.Fatalf("Error submitting while paused: %s", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := e.Handshakes(); n != 0 || e.InFlight() != 3 {
+		t.Fatalf("Sent while paused: %d handshakes, %d in flight", n, e.InFlight())
+	}
+	e.Resume()
+	for i, status := range statuses {
+		if err := <-status; err != nil {
+			t.Errorf("Error sending message %d after resuming: %s", i, err)
+		}
+	}
+	// Close delivers what queued while paused
+	e.Pause()
+	status := make(chan error, 1)
+	if err := e.Submit(&Message{Host: "host3", Status: status}); err != nil {
+		t.Fatalf("Error submitting while paused: %s", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Error closing paused endpoint: %s", err)
+	}
+	if err := <-status; err != nil {
+		t.Errorf("Error draining paused endpoint: %s", err)
+	}
+	if b := <-received; len(b) != 4*720 {
+		t.Errorf("Expected 4 packets, got %d bytes", len(b))
+	}
+
+	// Close does not wait forever for submissions blocked on the full queue
+	e = StartEndpoint(ServerInfo{DryRun: true}, 1)
+	e.Pause()
+	if err := e.Submit(&Message{Host: "queued"}); err != nil {
+		t.Fatalf("Error submitting while paused: %s", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.Submit(&Message{Host: "blocked"})
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.SubmitTimeout(&Message{Host: "timeout"}, time.Hour)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan error)
+	go func() { closed <- e.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Error closing paused endpoint with a full queue: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Close of a paused endpoint with a full queue did not return")
+	}
+	wg.Wait()
+}
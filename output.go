@@ -0,0 +1,90 @@
+package nsca
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// outputReplacer implements ServerInfo.SanitizeOutput.
+var outputReplacer = strings.NewReplacer(
+	"\r\n", `\n`,
+	"\n", `\n`,
+	"\r", `\n`,
+	"|", "¦",
+)
+
+// sanitizeOutput applies the transformations documented on ServerInfo.SanitizeOutput.
+func sanitizeOutput(output string) string {
+	output = outputReplacer.Replace(output)
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, output)
+}
+
+// ErrInvalidUTF8 is returned when the plugin output of a message is not valid UTF-8 and
+// ServerInfo.ReplaceInvalidUTF8 is not set.
+var ErrInvalidUTF8 = errors.New("Plugin output is not valid UTF-8")
+
+// pluginOutput returns the plugin output to submit for m, with the transformations
+// enabled in the settings applied. Every transport uses it.
+func pluginOutput(m *Message, sanitize, replaceInvalidUTF8 bool) (string, error) {
+	output := m.Message
+	if !utf8.ValidString(output) {
+		if !replaceInvalidUTF8 {
+			return "", fmt.Errorf("%w: host %q, service %q", ErrInvalidUTF8, m.Host, m.Service)
+		}
+		output = strings.ToValidUTF8(output, string(utf8.RuneError))
+	}
+	if sanitize {
+		output = sanitizeOutput(output)
+	}
+	return output, nil
+}
+
+// truncateOutput cuts output that is longer than max bytes so that, with marker appended,
+// it is exactly max bytes or just under, never splitting a UTF-8 sequence. A marker
+// longer than max is itself cut to max bytes.
+func truncateOutput(output, marker string, max int) string {
+	if len(output) <= max {
+		return output
+	}
+	if len(marker) >= max {
+		// too long to mark the cut: the marker is cut instead, between UTF-8 sequences too
+		output, marker = marker, ""
+		if len(output) <= max {
+			return output
+		}
+	}
+	end := max - len(marker)
+	for end > 0 && !utf8.RuneStart(output[end]) {
+		end--
+	}
+	return output[:end] + marker
+}
+
+// outputLimit returns the most plugin output bytes a packet carries with
+// ServerInfo.MaxOutputBytes set to max.
+func outputLimit(max int) int {
+	if max > 0 && max < PluginOutputLength-1 {
+		return max
+	}
+	return PluginOutputLength - 1
+}
+
+// rewriteTarget returns the host and service to send for m, mapped by the
+// ServerInfo.HostRewriter and ServiceRewriter functions that are set.
+func rewriteTarget(m *Message, host, service func(string) string) (string, string) {
+	h, s := m.Host, m.Service
+	if host != nil {
+		h = host(h)
+	}
+	if service != nil {
+		s = service(s)
+	}
+	return h, s
+}
@@ -5,11 +5,17 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/des"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -49,25 +55,233 @@ const (
 	ENCRYPT_SAFERPLUS          /* SAFER+ */              /* UNUSED */
 )
 
+// Layout of the NSCA packets, for packet version 3 as sent by this client and by send_nsca
+// 2.7 through 2.7.2. Daemons built with a larger MAX_PLUGINOUTPUT_LENGTH (4096 in NSCA 2.9)
+// expect a larger data packet and are not supported. Integers are big-endian, strings are
+// null terminated within their fields, and every field is padded like the C struct.
+const (
+	// InitIVLength is the length of the IV at the start of the initialization packet.
+	InitIVLength = 128
+	// InitPacketSize is the length of the initialization packet: the IV followed by a
+	// 4 byte timestamp.
+	InitPacketSize = InitIVLength + 4
+
+	// PacketVersion is the packet version written in every data packet.
+	PacketVersion = 3
+	// HostNameLength is the length of the host name field, including the null terminator.
+	HostNameLength = 64
+	// ServiceLength is the length of the service description field, including the null
+	// terminator.
+	ServiceLength = 128
+	// PluginOutputLength is the length of the plugin output field, including the null
+	// terminator.
+	PluginOutputLength = 512
+
+	// CRCOffset is the offset of the CRC32 of the data packet, which is computed over the
+	// whole packet with this field set to zero.
+	CRCOffset = 4
+	// TimestampOffset is the offset of the timestamp in the data packet.
+	TimestampOffset = 8
+	// ReturnCodeOffset is the offset of the return code (state) in the data packet.
+	ReturnCodeOffset = 12
+	// HostNameOffset is the offset of the host name field in the data packet.
+	HostNameOffset = 14
+	// ServiceOffset is the offset of the service description field in the data packet.
+	ServiceOffset = HostNameOffset + HostNameLength
+	// PluginOutputOffset is the offset of the plugin output field in the data packet.
+	PluginOutputOffset = ServiceOffset + ServiceLength
+	// DataPacketSize is the length of a data packet, including 2 bytes of trailing padding.
+	DataPacketSize = PluginOutputOffset + PluginOutputLength + 2
+	// HMACSize is the length of the HMAC that follows each data packet with
+	// ServerInfo.HMACKey.
+	HMACSize = sha256.Size
+)
+
+// ErrEncryptionUnsupported is returned (wrapped with the method number and name) when an
+// encryption method defined by NSCA is not implemented by this package.
+var ErrEncryptionUnsupported = errors.New("Unsupported encryption method")
+
+// ErrEncryptionSetup is returned, wrapping the cause, when the cipher for a session
+// cannot be set up, for example because a ServerInfo.KeyDeriver returned a key of a
+// length the cipher does not accept.
+var ErrEncryptionSetup = errors.New("Encryption setup failed")
+
+// encryptionNames maps encryption methods to their libmcrypt algorithm names.
+var encryptionNames = map[int]string{
+	ENCRYPT_NONE:        "none",
+	ENCRYPT_XOR:         "xor",
+	ENCRYPT_DES:         "des",
+	ENCRYPT_3DES:        "tripledes",
+	ENCRYPT_CAST128:     "cast-128",
+	ENCRYPT_CAST256:     "cast-256",
+	ENCRYPT_XTEA:        "xtea",
+	ENCRYPT_3WAY:        "threeway",
+	ENCRYPT_BLOWFISH:    "blowfish",
+	ENCRYPT_TWOFISH:     "twofish",
+	ENCRYPT_LOKI97:      "loki97",
+	ENCRYPT_RC2:         "rc2",
+	ENCRYPT_ARCFOUR:     "arcfour",
+	ENCRYPT_RC6:         "rc6",
+	ENCRYPT_RIJNDAEL128: "rijndael-128",
+	ENCRYPT_RIJNDAEL192: "rijndael-192",
+	ENCRYPT_RIJNDAEL256: "rijndael-256",
+	ENCRYPT_MARS:        "mars",
+	ENCRYPT_PANAMA:      "panama",
+	ENCRYPT_WAKE:        "wake",
+	ENCRYPT_SERPENT:     "serpent",
+	ENCRYPT_IDEA:        "idea",
+	ENCRYPT_ENIGMA:      "enigma",
+	ENCRYPT_GOST:        "gost",
+	ENCRYPT_SAFER64:     "safer-sk64",
+	ENCRYPT_SAFER128:    "safer-sk128",
+	ENCRYPT_SAFERPLUS:   "saferplus",
+}
+
+// ErrEmptyPassword is returned when an encryption method other than ENCRYPT_NONE is
+// configured without a password. The daemon would otherwise be sent packets keyed from
+// an all-zero key, which it almost certainly does not expect.
+var ErrEmptyPassword = errors.New("Zero length password")
+
+// supportedEncryptionMethods lists the encryption methods implemented by this package.
+var supportedEncryptionMethods = []int{
+	ENCRYPT_NONE,
+	ENCRYPT_XOR,
+	ENCRYPT_DES,
+	ENCRYPT_3DES,
+	ENCRYPT_RIJNDAEL128,
+	ENCRYPT_RIJNDAEL192,
+	ENCRYPT_RIJNDAEL256,
+}
+
+// IsEncryptionSupported reports whether method is an encryption method implemented by this package.
+func IsEncryptionSupported(method int) bool {
+	for _, m := range supportedEncryptionMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportedEncryptionMethods returns the encryption methods implemented by this package.
+func SupportedEncryptionMethods() []int {
+	methods := make([]int, len(supportedEncryptionMethods))
+	copy(methods, supportedEncryptionMethods)
+	return methods
+}
+
+// BlockMode is the mode of operation used with the block cipher encryption methods.
+type BlockMode int
+
+const (
+	// BlockModeCFB8 is 8-bit cipher feedback mode, one cipher call per byte, which is
+	// what libmcrypt implements as "cfb", the mode nsca and send_nsca open the cipher
+	// with. It is the default.
+	BlockModeCFB8 BlockMode = iota
+	// BlockModeCFB is full-block cipher feedback mode, as crypto/cipher implements it,
+	// and the mode this package used before BlockModeCFB8 was added. It is not the mode
+	// libmcrypt calls "cfb", so only a daemon built to match it can decrypt its packets.
+	BlockModeCFB
+	// BlockModeCBC is cipher block chaining mode, for daemons built to use it. Data
+	// packets are a whole number of blocks for every supported cipher, so no padding is
+	// needed.
+	BlockModeCBC
+	// BlockModeOFB is output feedback mode, for daemons built to use it.
+	BlockModeOFB
+)
+
+func (m BlockMode) String() string {
+	switch m {
+	case BlockModeCFB:
+		return "CFB"
+	case BlockModeCBC:
+		return "CBC"
+	case BlockModeOFB:
+		return "OFB"
+	case BlockModeCFB8:
+		return "CFB8"
+	}
+	return "Unknown"
+}
+
+// encryptionAliases are the other names ParseEncryptionMethod accepts.
+var encryptionAliases = map[string]int{
+	"aes128":     ENCRYPT_RIJNDAEL128,
+	"aes-128":    ENCRYPT_RIJNDAEL128,
+	"aes192":     ENCRYPT_RIJNDAEL192,
+	"aes-192":    ENCRYPT_RIJNDAEL192,
+	"aes256":     ENCRYPT_RIJNDAEL256,
+	"aes-256":    ENCRYPT_RIJNDAEL256,
+	"triple-des": ENCRYPT_3DES,
+	"3des":       ENCRYPT_3DES,
+}
+
+// ParseEncryptionMethod returns the encryption method with the given name: its libmcrypt
+// algorithm name (such as "rijndael-256" or "tripledes"), one of the aliases "aes128",
+// "aes192" and "aes256" (with or without a dash), "triple-des" or "3des", or its number
+// as a decimal string, which is how the encryption_method setting of send_nsca.cfg and
+// nsca.cfg gives it. Names are not case sensitive. The method is not required to be supported by this package; see
+// IsEncryptionSupported.
+func ParseEncryptionMethod(name string) (int, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if method, err := strconv.Atoi(name); err == nil {
+		if _, ok := encryptionNames[method]; ok {
+			return method, nil
+		}
+		return 0, fmt.Errorf("Unrecognized encryption method %d", method)
+	}
+	for method, n := range encryptionNames {
+		if n == name {
+			return method, nil
+		}
+	}
+	if method, ok := encryptionAliases[name]; ok {
+		return method, nil
+	}
+	return 0, fmt.Errorf("Unrecognized encryption method %q", name)
+}
+
 type dataPacket struct {
 	packetVersion      int16
 	crc32              uint32
 	timestamp          uint32
 	returnCode         int16
-	hostName           string // 64 char max
-	serviceDescription string // 128 char max
-	pluginOutput       string // 512 char max
+	hostName           string              // HostNameLength-1 char max
+	serviceDescription string              // ServiceLength-1 char max
+	pluginOutput       string              // PluginOutputLength-1 char max
+	padding            io.Reader           // fills each field after its string; crypto/rand if nil
+	hmacKey            []byte              // if set, encode appends an HMAC of the cleartext
+	crc                func([]byte) uint32 // computes the packet CRC; crc32.ChecksumIEEE if nil
 }
 
 type initializationPacket struct {
-	iv        []byte // 128 bytes
+	iv        []byte // InitIVLength bytes
 	timestamp uint32
 }
 
 type encryption struct {
-	method   int
-	iv       []byte
-	password []byte
+	method     int
+	iv         []byte
+	password   []byte
+	keyDeriver func(password string, keyLen int) []byte
+	mode       BlockMode
+	block      cipher.Block // set by prepare
+}
+
+// key returns the cipher key of length keyLen derived from the password.
+func (e *encryption) key(keyLen int) []byte {
+	if e.keyDeriver != nil {
+		return e.keyDeriver(string(e.password), keyLen)
+	}
+	return DefaultKeyDeriver(string(e.password), keyLen)
+}
+
+// DefaultKeyDeriver is the key derivation used by NSCA with libmcrypt: the password,
+// truncated or padded with zero bytes to keyLen.
+func DefaultKeyDeriver(password string, keyLen int) []byte {
+	key := make([]byte, keyLen)
+	copy(key, password)
+	return key
 }
 
 func (e *encryption) encrypt(b []byte) error {
@@ -75,29 +289,154 @@ func (e *encryption) encrypt(b []byte) error {
 		return nil
 	}
 	if len(e.password) == 0 {
-		return fmt.Errorf("Zero length password")
+		return ErrEmptyPassword
 	}
 	if e.method == ENCRYPT_XOR {
-		for i := range b {
-			b[i] = b[i] ^ e.iv[i%len(e.iv)] ^ e.password[i%len(e.password)]
+		e.xor(b)
+		return nil
+	}
+	block, err := e.cipher()
+	if err != nil {
+		return err
+	}
+	iv := e.iv[:block.BlockSize()]
+	switch e.mode {
+	case BlockModeCBC:
+		if len(b)%block.BlockSize() != 0 {
+			return fmt.Errorf("CBC mode needs whole blocks: %d bytes is not a multiple of %d", len(b), block.BlockSize())
 		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(b, b)
+	case BlockModeOFB:
+		cipher.NewOFB(block, iv).XORKeyStream(b, b)
+	case BlockModeCFB:
+		cipher.NewCFBEncrypter(block, iv).XORKeyStream(b, b)
+	default:
+		cfb8(block, iv, b, false)
+	}
+	return nil
+}
+
+func (e *encryption) decrypt(b []byte) error {
+	if e.method == ENCRYPT_NONE {
 		return nil
 	}
+	if len(e.password) == 0 {
+		return ErrEmptyPassword
+	}
+	if e.method == ENCRYPT_XOR {
+		// XOR is its own inverse
+		e.xor(b)
+		return nil
+	}
+	block, err := e.cipher()
+	if err != nil {
+		return err
+	}
+	iv := e.iv[:block.BlockSize()]
+	switch e.mode {
+	case BlockModeCBC:
+		if len(b)%block.BlockSize() != 0 {
+			return fmt.Errorf("CBC mode needs whole blocks: %d bytes is not a multiple of %d", len(b), block.BlockSize())
+		}
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(b, b)
+	case BlockModeOFB:
+		cipher.NewOFB(block, iv).XORKeyStream(b, b)
+	case BlockModeCFB:
+		cipher.NewCFBDecrypter(block, iv).XORKeyStream(b, b)
+	default:
+		cfb8(block, iv, b, true)
+	}
+	return nil
+}
+
+// cfb8 encrypts or decrypts b in place in 8-bit cipher feedback mode: each byte is XORed
+// with the first byte of the encrypted shift register, which then shifts in the byte of
+// ciphertext.
+func cfb8(block cipher.Block, iv, b []byte, decrypt bool) {
+	reg := append([]byte{}, iv...)
+	out := make([]byte, len(reg))
+	for i := range b {
+		block.Encrypt(out, reg)
+		fed := b[i]
+		b[i] ^= out[0]
+		if !decrypt {
+			fed = b[i]
+		}
+		copy(reg, reg[1:])
+		reg[len(reg)-1] = fed
+	}
+}
+
+func (e *encryption) xor(b []byte) {
+	for i := range b {
+		b[i] = b[i] ^ e.iv[i%len(e.iv)] ^ e.password[i%len(e.password)]
+	}
+}
+
+// wipe zeroes the password and drops the cipher, so the session's secrets do not outlive it.
+func (e *encryption) wipe() {
+	clear(e.password)
+	e.block = nil
+}
+
+// ivLen returns how many bytes of the IV the method uses.
+func (e *encryption) ivLen() int {
+	switch e.method {
+	case ENCRYPT_NONE:
+		return 0
+	case ENCRYPT_XOR:
+		return len(e.iv)
+	}
+	block, err := e.cipher()
+	if err != nil {
+		return 0
+	}
+	return block.BlockSize()
+}
+
+// prepare sets up the block cipher once, so that it is reused for every packet instead of
+// being derived again from the password. It must be called after keyDeriver is set. It
+// returns an error wrapping ErrEncryptionSetup if the cipher cannot be created.
+func (e *encryption) prepare() error {
+	if e.method == ENCRYPT_NONE || e.method == ENCRYPT_XOR {
+		return nil
+	}
+	block, err := e.newBlock()
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrEncryptionSetup, encryptionNames[e.method], err)
+	}
+	e.block = block
+	return nil
+}
+
+// cipher returns the block cipher set up by prepare, or a new one.
+func (e *encryption) cipher() (cipher.Block, error) {
+	if e.block != nil {
+		return e.block, nil
+	}
+	return e.newBlock()
+}
+
+func (e *encryption) newBlock() (cipher.Block, error) {
 	var err error
 	var block cipher.Block
-	key := make([]byte, 128)
-	copy(key, e.password)
+	var key []byte
 	switch e.method {
 	case ENCRYPT_DES:
-		block, err = des.NewCipher(key[:des.BlockSize])
+		key = e.key(des.BlockSize)
+		block, err = des.NewCipher(key)
 	case ENCRYPT_3DES:
-		block, err = des.NewTripleDESCipher(key[:des.BlockSize*3])
+		key = e.key(des.BlockSize * 3)
+		block, err = des.NewTripleDESCipher(key)
 	case ENCRYPT_RIJNDAEL128:
-		block, err = aes.NewCipher(key[:16])
+		key = e.key(16)
+		block, err = aes.NewCipher(key)
 	case ENCRYPT_RIJNDAEL192:
-		block, err = aes.NewCipher(key[:24])
+		key = e.key(24)
+		block, err = aes.NewCipher(key)
 	case ENCRYPT_RIJNDAEL256:
-		block, err = aes.NewCipher(key[:32])
+		key = e.key(32)
+		block, err = aes.NewCipher(key)
 	case ENCRYPT_CAST128:
 		fallthrough
 	case ENCRYPT_CAST256:
@@ -114,6 +453,8 @@ func (e *encryption) encrypt(b []byte) error {
 		fallthrough
 	case ENCRYPT_RC2:
 		fallthrough
+	// crypto/rc4 implements ARCFOUR, but it is a stream cipher, which libmcrypt refuses
+	// to open in the "cfb" mode nsca and send_nsca use, so no daemon can decrypt it.
 	case ENCRYPT_ARCFOUR:
 		fallthrough
 	case ENCRYPT_RC6:
@@ -137,16 +478,18 @@ func (e *encryption) encrypt(b []byte) error {
 	case ENCRYPT_SAFER128:
 		fallthrough
 	case ENCRYPT_SAFERPLUS:
-		err = fmt.Errorf("Unsupported encryption method")
+		err = fmt.Errorf("%w %d (%s)", ErrEncryptionUnsupported, e.method, encryptionNames[e.method])
 	default:
-		err = fmt.Errorf("Unrecognized encryption method")
+		err = fmt.Errorf("Unrecognized encryption method %d", e.method)
+	}
+	if e.keyDeriver == nil {
+		// the cipher keeps its own copy; a custom deriver may still own the key it returned
+		clear(key)
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	enc := cipher.NewCFBEncrypter(block, e.iv[:block.BlockSize()])
-	enc.XORKeyStream(b, b)
-	return nil
+	return block, nil
 }
 
 func newEncryption(method int, iv []byte, password string) *encryption {
@@ -160,32 +503,81 @@ func newEncryption(method int, iv []byte, password string) *encryption {
 	return &e
 }
 
-func readInitializationPacket(reader io.Reader) (*initializationPacket, error) {
-	p := initializationPacket{iv: make([]byte, 128)}
-	err := binary.Read(reader, binary.BigEndian, p.iv)
+// SelfTest encrypts a sample data packet with the given method and password using a random
+// IV, then decrypts and decodes it again, all in memory. It returns an error if the method
+// is not implemented or the packet does not round trip.
+func SelfTest(method int, password string) error {
+	iv := make([]byte, InitIVLength)
+	_, err := rand.Read(iv)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	e := newEncryption(method, iv, password)
+	p := newDataPacket(uint32(time.Now().Unix()), STATE_OK, "selftest", "selftest", "NSCA encryption self test")
+	b, err := p.encode(e)
+	if err != nil {
+		return err
+	}
+	return p.verify(b, e)
+}
+
+// ErrBadInitPacket is returned when the server's initialization packet is too short or
+// otherwise malformed.
+var ErrBadInitPacket = errors.New("Bad initialization packet")
+
+// readInitializationPacket reads exactly one initialization packet from reader. It never
+// reads past the end of the packet.
+func readInitializationPacket(reader io.Reader) (*initializationPacket, error) {
+	b := make([]byte, InitPacketSize)
+	n, err := io.ReadFull(reader, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%w: read %d of %d bytes: %w", ErrBadInitPacket, n, len(b), err)
 	}
-	err = binary.Read(reader, binary.BigEndian, &p.timestamp)
 	if err != nil {
 		return nil, err
 	}
+	return parseInitializationPacket(b)
+}
+
+// parseInitializationPacket parses a complete initialization packet: the IV followed by a
+// 4 byte timestamp.
+func parseInitializationPacket(b []byte) (*initializationPacket, error) {
+	if len(b) != InitPacketSize {
+		return nil, fmt.Errorf("%w: expected %d bytes, got %d", ErrBadInitPacket, InitPacketSize, len(b))
+	}
+	p := initializationPacket{iv: make([]byte, InitIVLength)}
+	copy(p.iv, b[:InitIVLength])
+	p.timestamp = binary.BigEndian.Uint32(b[InitIVLength:])
 	return &p, nil
 }
 
+// ParseInitPacket parses an initialization packet captured from a daemon, returning the
+// InitIVLength byte IV and the timestamp exactly as Connect reads them. The IV is a copy,
+// and is returned as is even if it is all zeros. data must be exactly InitPacketSize
+// bytes; otherwise the error wraps ErrBadInitPacket.
+func ParseInitPacket(data []byte) (iv []byte, timestamp uint32, err error) {
+	p, err := parseInitializationPacket(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return p.iv, p.timestamp, nil
+}
+
 func makeBuffer(s string, length int) ([]byte, error) {
+	return fillBuffer(rand.Reader, s, length)
+}
+
+// fillBuffer is makeBuffer with the bytes after s read from padding.
+func fillBuffer(padding io.Reader, s string, length int) ([]byte, error) {
 	if length == 0 {
 		return make([]byte, 0), nil
 	}
 	b := make([]byte, length)
-	n, err := rand.Read(b)
+	_, err := io.ReadFull(padding, b)
 	if err != nil {
 		return nil, err
 	}
-	if n != len(b) {
-		return nil, fmt.Errorf("Unexpected result from rand.Read")
-	}
-	n = copy(b, s)
+	n := copy(b, s)
 	if n == len(b) {
 		b[len(b)-1] = 0
 	} else {
@@ -196,7 +588,7 @@ func makeBuffer(s string, length int) ([]byte, error) {
 
 func newDataPacket(serverTimestamp uint32, returnCode int16, hostName, serviceDescription, pluginOutput string) *dataPacket {
 	d := dataPacket{
-		packetVersion:      3,
+		packetVersion:      PacketVersion,
 		timestamp:          serverTimestamp,
 		returnCode:         returnCode,
 		hostName:           hostName,
@@ -207,26 +599,39 @@ func newDataPacket(serverTimestamp uint32, returnCode int16, hostName, serviceDe
 }
 
 func (p *dataPacket) write(w io.Writer, e *encryption) error {
+	b, err := p.encode(e)
+	if err != nil {
+		return err
+	}
+	return writePacket(w, b)
+}
+
+// encode returns the encrypted wire representation of the packet.
+func (p *dataPacket) encode(e *encryption) ([]byte, error) {
 	if p.packetVersion == 0 {
-		p.packetVersion = 3
+		p.packetVersion = PacketVersion
 	}
 	p.crc32 = 0
-	hostName, err := makeBuffer(p.hostName, 64)
+	fill := p.padding
+	if fill == nil {
+		fill = rand.Reader
+	}
+	hostName, err := fillBuffer(fill, p.hostName, HostNameLength)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	service, err := makeBuffer(p.serviceDescription, 128)
+	service, err := fillBuffer(fill, p.serviceDescription, ServiceLength)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	output, err := makeBuffer(p.pluginOutput, 512)
+	output, err := fillBuffer(fill, p.pluginOutput, PluginOutputLength)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// 2 bytes for c struct padding
-	padding, err := makeBuffer("", 2)
+	padding, err := fillBuffer(fill, "", 2)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, p.packetVersion)
@@ -240,20 +645,138 @@ func (p *dataPacket) write(w io.Writer, e *encryption) error {
 	binary.Write(buf, binary.BigEndian, padding)
 
 	b := buf.Bytes()
-	p.crc32 = crc32.ChecksumIEEE(b)
+	p.crc32 = p.checksum(b)
 	crc := make([]byte, 4)
 	binary.BigEndian.PutUint32(crc, p.crc32)
-	copy(b[4:], crc)
+	copy(b[CRCOffset:], crc)
+	var sum []byte
+	if p.hmacKey != nil {
+		mac := hmac.New(sha256.New, p.hmacKey)
+		mac.Write(b)
+		sum = mac.Sum(nil)
+	}
 	err = e.encrypt(b)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	n, err := w.Write(b)
+	return append(b, sum...), nil
+}
+
+// ErrShortWrite is returned, wrapping the underlying error if there is one, when only part
+// of a packet, or of the packets a batch buffered, was written before the write failed.
+// The daemon discards the incomplete packet, so its message was not accepted. A write
+// that fails before writing anything returns the underlying error alone.
+var ErrShortWrite = errors.New("Short write")
+
+func writePacket(w io.Writer, b []byte) error {
+	_, err := checkedWriter{w}.Write(b)
+	return err
+}
+
+// checkedWriter reports a partial write to w as ErrShortWrite, as writePacket does, for
+// writes made on its behalf, such as the flushes of a buffered writer.
+type checkedWriter struct {
+	w io.Writer
+}
+
+func (c checkedWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if (n > 0 && n < len(b)) || (n != len(b) && err == nil) {
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		return n, fmt.Errorf("%w: wrote %d of %d bytes: %w", ErrShortWrite, n, len(b), err)
+	}
+	return n, err
+}
+
+// ErrCRCMismatch is returned when the CRC32 embedded in a data packet does not match the
+// CRC32 of the packet computed the way the daemon does, over the cleartext with the CRC
+// field zeroed. The daemon silently drops such packets. With ServerInfo.VerifyOutgoing,
+// Send checks every outgoing packet and fails with this error.
+var ErrCRCMismatch = errors.New("Data packet CRC mismatch")
+
+// checksum returns the CRC of b computed with p.crc, or the standard NSCA CRC32 without one.
+func (p *dataPacket) checksum(b []byte) uint32 {
+	if p.crc != nil {
+		return p.crc(b)
+	}
+	return crc32.ChecksumIEEE(b)
+}
+
+// decodeDataPacket decrypts a copy of b and parses it back into a dataPacket,
+// checking the length and CRC the same way the daemon does.
+func decodeDataPacket(b []byte, e *encryption) (*dataPacket, error) {
+	return decodeDataPacketCRC(b, e, nil)
+}
+
+// decodeDataPacketCRC is decodeDataPacket checking the CRC with crc instead of the
+// standard CRC32, if crc is not nil.
+func decodeDataPacketCRC(b []byte, e *encryption, crc func([]byte) uint32) (*dataPacket, error) {
+	if len(b) != DataPacketSize {
+		return nil, fmt.Errorf("Bad data packet length: expected %d, got %d", DataPacketSize, len(b))
+	}
+	plain := make([]byte, len(b))
+	copy(plain, b)
+	err := e.decrypt(plain)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	p := dataPacket{
+		packetVersion:      int16(binary.BigEndian.Uint16(plain[0:])),
+		crc32:              binary.BigEndian.Uint32(plain[CRCOffset:]),
+		timestamp:          binary.BigEndian.Uint32(plain[TimestampOffset:]),
+		returnCode:         int16(binary.BigEndian.Uint16(plain[ReturnCodeOffset:])),
+		hostName:           cString(plain[HostNameOffset:ServiceOffset]),
+		serviceDescription: cString(plain[ServiceOffset:PluginOutputOffset]),
+		pluginOutput:       cString(plain[PluginOutputOffset : PluginOutputOffset+PluginOutputLength]),
+		crc:                crc,
+	}
+	copy(plain[CRCOffset:CRCOffset+4], []byte{0, 0, 0, 0})
+	if crc := p.checksum(plain); crc != p.crc32 {
+		return nil, fmt.Errorf("%w: computed %d, packet has %d", ErrCRCMismatch, crc, p.crc32)
+	}
+	return &p, nil
+}
+
+// cString returns the contents of b up to the first null byte.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// truncate mirrors the truncation makeBuffer applies to a field of the given length.
+func truncate(s string, length int) string {
+	if len(s) >= length {
+		return s[:length-1]
+	}
+	return s
+}
+
+// verify decodes an encoded packet and checks that it round trips back to p.
+func (p *dataPacket) verify(b []byte, e *encryption) error {
+	d, err := decodeDataPacketCRC(b, e, p.crc)
+	if err != nil {
+		return fmt.Errorf("Outgoing packet failed verification: %w", err)
 	}
-	if n != len(b) {
-		return fmt.Errorf("Wrong byte count returned from write: expected %d, got %d", len(b), n)
+	switch {
+	case d.packetVersion != p.packetVersion:
+		err = fmt.Errorf("packet version %d, expected %d", d.packetVersion, p.packetVersion)
+	case d.timestamp != p.timestamp:
+		err = fmt.Errorf("timestamp %d, expected %d", d.timestamp, p.timestamp)
+	case d.returnCode != p.returnCode:
+		err = fmt.Errorf("return code %d, expected %d", d.returnCode, p.returnCode)
+	case d.hostName != truncate(p.hostName, HostNameLength):
+		err = fmt.Errorf("host name %q, expected %q", d.hostName, truncate(p.hostName, HostNameLength))
+	case d.serviceDescription != truncate(p.serviceDescription, ServiceLength):
+		err = fmt.Errorf("service %q, expected %q", d.serviceDescription, truncate(p.serviceDescription, ServiceLength))
+	case d.pluginOutput != truncate(p.pluginOutput, PluginOutputLength):
+		err = fmt.Errorf("plugin output %q, expected %q", d.pluginOutput, truncate(p.pluginOutput, PluginOutputLength))
+	}
+	if err != nil {
+		return fmt.Errorf("Outgoing packet failed verification: %s", err)
 	}
 	return nil
 }
@@ -2,9 +2,19 @@ package nsca
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"net"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -63,9 +73,27 @@ func testEncryptionMethod(method int, shouldFail bool, t *testing.T) {
 		t.Errorf("Encryption error on %d: %s", method, err)
 	} else if shouldFail && err == nil {
 		t.Errorf("Should have failed on %d, but no error", method)
+	} else if shouldFail && !errors.Is(err, ErrEncryptionUnsupported) {
+		t.Errorf("Expected ErrEncryptionUnsupported on %d, got %s", method, err)
+	}
+	if err == nil {
+		err = e.decrypt(plain)
+		if err != nil {
+			t.Errorf("Decryption error on %d: %s", method, err)
+		} else if string(plain) != "hello" {
+			t.Errorf("Bad round trip on %d: got %q", method, plain)
+		}
+	}
+	if err = SelfTest(method, password); (err != nil) != shouldFail {
+		t.Errorf("SelfTest on %d returned %v", method, err)
+	}
+	if d, err := BenchmarkCipher(method, password); (err != nil) != shouldFail || (err == nil && d <= 0) {
+		t.Errorf("BenchmarkCipher on %d returned %s, %v", method, d, err)
+	}
+	if IsEncryptionSupported(method) == shouldFail {
+		t.Errorf("IsEncryptionSupported(%d) returned %v", method, !shouldFail)
 	}
 	// TODO: test some boundary conditions on iv, password and plain
-	// TODO: implement a decrypt method so we can test round trip
 }
 
 func TestEncryption(t *testing.T) {
@@ -99,6 +127,136 @@ func TestEncryption(t *testing.T) {
 	testEncryptionMethod(ENCRYPT_SAFERPLUS, true, t)
 }
 
+func TestBlockMode(t *testing.T) {
+	iv := make([]byte, InitIVLength)
+	rand.Read(iv)
+	plain := make([]byte, DataPacketSize)
+	rand.Read(plain)
+	ciphertexts := make(map[BlockMode][]byte)
+	for _, mode := range []BlockMode{BlockModeCFB, BlockModeCBC, BlockModeOFB, BlockModeCFB8} {
+		for _, method := range []int{ENCRYPT_DES, ENCRYPT_3DES, ENCRYPT_RIJNDAEL256} {
+			e := newEncryption(method, iv, "password")
+			e.mode = mode
+			b := append([]byte{}, plain...)
+			if err := e.encrypt(b); err != nil {
+				t.Fatalf("%s, method %d: error encrypting: %s", mode, method, err)
+			}
+			if method == ENCRYPT_RIJNDAEL256 {
+				ciphertexts[mode] = append([]byte{}, b...)
+			}
+			if err := e.decrypt(b); err != nil || !bytes.Equal(b, plain) {
+				t.Errorf("%s, method %d: round trip failed: %v", mode, method, err)
+			}
+		}
+	}
+	if bytes.Equal(ciphertexts[BlockModeCFB], ciphertexts[BlockModeCBC]) ||
+		bytes.Equal(ciphertexts[BlockModeCFB], ciphertexts[BlockModeOFB]) ||
+		bytes.Equal(ciphertexts[BlockModeCFB], ciphertexts[BlockModeCFB8]) {
+		t.Errorf("Block modes produce the same ciphertext")
+	}
+	// the default is libmcrypt's "cfb", as the reference daemon uses
+	e := newEncryption(ENCRYPT_RIJNDAEL256, iv, "password")
+	b := append([]byte{}, plain...)
+	if e.encrypt(b); !bytes.Equal(b, ciphertexts[BlockModeCFB8]) {
+		t.Errorf("Expected the default block mode to be CFB8")
+	}
+	// CFB8-AES128 example from NIST SP 800-38A, F.3.7
+	block, _ := aes.NewCipher(mustHex(t, "2b7e151628aed2a6abf7158809cf4f3c"))
+	b = mustHex(t, "6bc1bee22e409f96e93d7e117393172aae2d")
+	cfb8(block, mustHex(t, "000102030405060708090a0b0c0d0e0f"), b, false)
+	if want := mustHex(t, "3b79424c9c0dd436bace9e0ed4586a4f32b9"); !bytes.Equal(b, want) {
+		t.Errorf("Bad CFB8 ciphertext: expected %x, got %x", want, b)
+	}
+	e = newEncryption(ENCRYPT_RIJNDAEL128, iv, "password")
+	e.mode = BlockModeCBC
+	if err := e.encrypt(make([]byte, 17)); err == nil {
+		t.Errorf("Expected an error encrypting a partial block in CBC mode")
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("Bad hex %q: %s", s, err)
+	}
+	return b
+}
+
+func TestEmptyPassword(t *testing.T) {
+	iv := make([]byte, 128)
+	for _, method := range []int{ENCRYPT_XOR, ENCRYPT_DES, ENCRYPT_RIJNDAEL256} {
+		err := newEncryption(method, iv, "").encrypt([]byte("hello"))
+		if err != ErrEmptyPassword {
+			t.Errorf("Expected ErrEmptyPassword on %d, got %v", method, err)
+		}
+		_, err = CaptureSend(ServerInfo{EncryptionMethod: method}, iv, 0, &Message{Host: "host"})
+		if err != ErrEmptyPassword {
+			t.Errorf("Expected ErrEmptyPassword from handshake on %d, got %v", method, err)
+		}
+	}
+	err := newEncryption(ENCRYPT_NONE, iv, "").encrypt([]byte("hello"))
+	if err != nil {
+		t.Errorf("ENCRYPT_NONE should not need a password: %s", err)
+	}
+}
+
+func TestKeyDeriver(t *testing.T) {
+	iv := make([]byte, 128)
+	rand.Read(iv)
+	plain := []byte("hello, key derivation")
+	standard := append([]byte{}, plain...)
+	newEncryption(ENCRYPT_RIJNDAEL256, iv, "password").encrypt(standard)
+
+	// a deriver that reproduces the default produces the same ciphertext
+	e := newEncryption(ENCRYPT_RIJNDAEL256, iv, "password")
+	var gotLen int
+	e.keyDeriver = func(password string, keyLen int) []byte {
+		gotLen = keyLen
+		return DefaultKeyDeriver(password, keyLen)
+	}
+	same := append([]byte{}, plain...)
+	e.encrypt(same)
+	if gotLen != 32 || !bytes.Equal(same, standard) {
+		t.Errorf("Default deriver mismatch: keyLen %d", gotLen)
+	}
+
+	// a different derivation produces a different key
+	e.keyDeriver = func(password string, keyLen int) []byte {
+		return bytes.Repeat([]byte{0xaa}, keyLen)
+	}
+	other := append([]byte{}, plain...)
+	e.encrypt(other)
+	if bytes.Equal(other, standard) {
+		t.Errorf("Custom deriver was not used")
+	}
+}
+
+func TestEncryptionSetup(t *testing.T) {
+	info := ServerInfo{
+		EncryptionMethod: ENCRYPT_RIJNDAEL128,
+		Password:         "password",
+		KeyDeriver:       func(password string, keyLen int) []byte { return []byte(password)[:5] },
+	}
+	_, err := NewEncoder(info, make([]byte, InitIVLength), 0)
+	if !errors.Is(err, ErrEncryptionSetup) {
+		t.Errorf("Expected ErrEncryptionSetup from NewEncoder, got %v", err)
+	}
+	client, server := net.Pipe()
+	go func() {
+		server.Write(make([]byte, InitPacketSize))
+		io.Copy(io.Discard, server)
+	}()
+	n := new(NSCAServer)
+	err = n.Handshake(client, info)
+	if !errors.Is(err, ErrEncryptionSetup) {
+		t.Errorf("Expected ErrEncryptionSetup from Handshake, got %v", err)
+	}
+	if n.conn != nil || n.encryption != nil {
+		t.Errorf("Failed handshake left a partial session")
+	}
+	server.Close()
+}
+
 func TestSession(t *testing.T) {
 	// read initialization from server
 	packet := new(bytes.Buffer)
@@ -129,6 +287,108 @@ func TestSession(t *testing.T) {
 		t.Errorf("Error writing message: %s", err)
 	} else {
 		// check message
+		err = msg.verify(writer.Bytes(), enc)
+		if err != nil {
+			t.Errorf("Error verifying message: %s", err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	iv := make([]byte, 128)
+	rand.Read(iv)
+	enc := newEncryption(ENCRYPT_RIJNDAEL256, iv, "testpassword")
+	long := string(bytes.Repeat([]byte("x"), 600))
+	msg := newDataPacket(1234, STATE_CRITICAL, "testHost", "testService", long)
+	b, err := msg.encode(enc)
+	if err != nil {
+		t.Fatalf("Error encoding message: %s", err)
+	}
+	err = msg.verify(b, enc)
+	if err != nil {
+		t.Errorf("Error verifying message: %s", err)
+	}
+	// a different password won't decrypt to a valid packet
+	err = msg.verify(b, newEncryption(ENCRYPT_RIJNDAEL256, iv, "otherpassword"))
+	if err == nil {
+		t.Errorf("Verification should have failed with the wrong password")
+	}
+	// corrupt the packet
+	b[20] ^= 0xff
+	err = msg.verify(b, enc)
+	if !errors.Is(err, ErrCRCMismatch) {
+		t.Errorf("Expected ErrCRCMismatch on a corrupted packet, got %v", err)
+	}
+}
+
+func TestInitializationPacket(t *testing.T) {
+	good := make([]byte, 132)
+	rand.Read(good)
+	binary.BigEndian.PutUint32(good[128:], 1234)
+	tests := []struct {
+		name   string
+		packet []byte
+		err    bool
+	}{
+		{"empty", []byte{}, true},
+		{"truncated iv", good[:100], true},
+		{"truncated timestamp", good[:130], true},
+		{"exact", good, false},
+		{"zero iv", append(make([]byte, 128), 0, 0, 0x04, 0xd2), false},
+	}
+	for _, test := range tests {
+		// feed the packet through a pipe, as a server would
+		client, server := net.Pipe()
+		go func() {
+			server.Write(test.packet)
+			server.Close()
+		}()
+		ip, err := readInitializationPacket(client)
+		client.Close()
+		if test.err {
+			if !errors.Is(err, ErrBadInitPacket) {
+				t.Errorf("%s: expected ErrBadInitPacket, got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(ip.iv, test.packet[:128]) || ip.timestamp != 1234 {
+			t.Errorf("%s: bad packet: iv %x, timestamp %d", test.name, ip.iv, ip.timestamp)
+		}
+	}
+	iv, ts, err := ParseInitPacket(good)
+	if err != nil || !bytes.Equal(iv, good[:128]) || ts != 1234 {
+		t.Errorf("ParseInitPacket: iv %x, timestamp %d, err %v", iv, ts, err)
+	}
+	iv, ts, err = ParseInitPacket(make([]byte, InitPacketSize))
+	if err != nil || !bytes.Equal(iv, make([]byte, InitIVLength)) || ts != 0 {
+		t.Errorf("ParseInitPacket of zeros: iv %x, timestamp %d, err %v", iv, ts, err)
+	}
+	if _, _, err := ParseInitPacket(good[:100]); !errors.Is(err, ErrBadInitPacket) {
+		t.Errorf("ParseInitPacket short: expected ErrBadInitPacket, got %v", err)
+	}
+	// an oversized packet is rejected outright when parsed, and over a connection
+	// only the packet itself is consumed
+	_, err = parseInitializationPacket(append(good, 1, 2, 3))
+	if !errors.Is(err, ErrBadInitPacket) {
+		t.Errorf("oversized: expected ErrBadInitPacket, got %v", err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		server.Write(append(append([]byte{}, good...), 1, 2, 3))
+		server.Close()
+	}()
+	ip, err := readInitializationPacket(client)
+	if err != nil || ip.timestamp != 1234 {
+		t.Errorf("oversized: unexpected result %+v, %v", ip, err)
+	}
+	rest, _ := io.ReadAll(client)
+	if !bytes.Equal(rest, []byte{1, 2, 3}) {
+		t.Errorf("oversized: read past the end of the packet, %d bytes left", len(rest))
 	}
 }
 
@@ -156,3 +416,311 @@ func TestServer(t *testing.T) {
 		}
 	}
 }
+
+func TestPacketLayout(t *testing.T) {
+	if DataPacketSize != 720 || InitPacketSize != 132 {
+		t.Errorf("Bad packet sizes: data %d, init %d", DataPacketSize, InitPacketSize)
+	}
+	msg := newDataPacket(1234, STATE_WARNING, "host", "service", "output")
+	b, err := msg.encode(newEncryption(ENCRYPT_NONE, nil, ""))
+	if err != nil {
+		t.Fatalf("Error encoding: %s", err)
+	}
+	if len(b) != DataPacketSize {
+		t.Fatalf("Bad packet length %d", len(b))
+	}
+	if binary.BigEndian.Uint16(b) != PacketVersion ||
+		binary.BigEndian.Uint32(b[CRCOffset:]) != msg.crc32 ||
+		binary.BigEndian.Uint32(b[TimestampOffset:]) != 1234 ||
+		binary.BigEndian.Uint16(b[ReturnCodeOffset:]) != STATE_WARNING ||
+		string(b[HostNameOffset:HostNameOffset+5]) != "host\x00" ||
+		string(b[ServiceOffset:ServiceOffset+8]) != "service\x00" ||
+		string(b[PluginOutputOffset:PluginOutputOffset+7]) != "output\x00" {
+		t.Errorf("Packet does not match the exported layout")
+	}
+}
+
+func TestEncodePacket(t *testing.T) {
+	iv := make([]byte, InitIVLength)
+	rand.Read(iv)
+	info := ServerInfo{EncryptionMethod: ENCRYPT_RIJNDAEL256, Password: "password"}
+	m := &Message{State: STATE_CRITICAL, Host: "host", Service: "service", Message: "output"}
+	b, err := EncodePacket(info, iv, 1234, m)
+	if err != nil {
+		t.Fatalf("Error encoding: %s", err)
+	}
+	p, err := decodeDataPacket(b, newEncryption(info.EncryptionMethod, iv, info.Password))
+	if err != nil {
+		t.Fatalf("Error decoding: %s", err)
+	}
+	if p.timestamp != 1234 || p.returnCode != m.State || p.hostName != m.Host ||
+		p.serviceDescription != m.Service || p.pluginOutput != m.Message {
+		t.Errorf("Bad packet: %+v", p)
+	}
+	e, err := NewEncoder(info, iv, 1234)
+	if err != nil {
+		t.Fatalf("Error creating encoder: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		again, err := e.Encode(m)
+		if err != nil || !bytes.Equal(again, b) {
+			t.Errorf("Encode %d is not deterministic: %v", i, err)
+		}
+	}
+	if _, err := NewEncoder(ServerInfo{EncryptionMethod: ENCRYPT_XOR}, iv, 0); err != ErrEmptyPassword {
+		t.Errorf("Expected ErrEmptyPassword, got %v", err)
+	}
+}
+
+func TestEncodeBatchTo(t *testing.T) {
+	iv := make([]byte, InitIVLength)
+	rand.Read(iv)
+	info := ServerInfo{EncryptionMethod: ENCRYPT_XOR, Password: "password"}
+	messages := []*Message{
+		{State: STATE_OK, Host: "host", Service: "one", Message: "first"},
+		{State: STATE_WARNING, Host: "host", Service: "two", Message: "second"},
+	}
+	var archive bytes.Buffer
+	n, err := EncodeBatchTo(&archive, info, iv, 1234, messages)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 messages written, got %d: %v", n, err)
+	}
+	for i, m := range messages {
+		b, err := EncodePacket(info, iv, 1234, m)
+		if err != nil {
+			t.Fatalf("Error encoding: %s", err)
+		}
+		if !bytes.Equal(archive.Bytes()[i*DataPacketSize:(i+1)*DataPacketSize], b) {
+			t.Errorf("Archived packet %d differs from EncodePacket", i)
+		}
+	}
+	n, err = EncodeBatchTo(&archive, ServerInfo{}, iv, 1234, append(messages, &Message{Host: "host", Message: "bad\xff"}))
+	if n != 2 || !errors.Is(err, ErrInvalidUTF8) {
+		t.Errorf("Expected 2 messages and ErrInvalidUTF8, got %d: %v", n, err)
+	}
+}
+
+func TestHMACKey(t *testing.T) {
+	iv := make([]byte, InitIVLength)
+	rand.Read(iv)
+	key := []byte("shared secret")
+	info := ServerInfo{EncryptionMethod: ENCRYPT_RIJNDAEL128, Password: "password", HMACKey: key, VerifyOutgoing: true}
+	m := &Message{State: STATE_OK, Host: "host", Service: "service", Message: "output"}
+	b, err := EncodePacket(info, iv, 1234, m)
+	if err != nil {
+		t.Fatalf("Error encoding: %s", err)
+	}
+	if len(b) != DataPacketSize+HMACSize || m.WireSize(info) != len(b) {
+		t.Fatalf("Expected %d bytes, got %d (WireSize %d)", DataPacketSize+HMACSize, len(b), m.WireSize(info))
+	}
+	enc := newEncryption(info.EncryptionMethod, iv, info.Password)
+	p, err := decodeDataPacket(b[:DataPacketSize], enc)
+	if err != nil || p.pluginOutput != "output" {
+		t.Fatalf("Bad packet %+v: %v", p, err)
+	}
+	plain := append([]byte{}, b[:DataPacketSize]...)
+	if err := enc.decrypt(plain); err != nil {
+		t.Fatalf("Error decrypting: %s", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(plain)
+	if !hmac.Equal(mac.Sum(nil), b[DataPacketSize:]) {
+		t.Errorf("HMAC does not match the cleartext packet")
+	}
+	if s := info.String(); strings.Contains(s, fmt.Sprint(key)) {
+		t.Errorf("String leaks the HMAC key: %s", s)
+	}
+}
+
+func TestCRC(t *testing.T) {
+	iv := make([]byte, InitIVLength)
+	castagnoli := crc32.MakeTable(crc32.Castagnoli)
+	crc := func(b []byte) uint32 { return crc32.Checksum(b, castagnoli) }
+	info := ServerInfo{EncryptionMethod: ENCRYPT_XOR, Password: "password", CRC: crc, VerifyOutgoing: true}
+	b, err := EncodePacket(info, iv, 1234, &Message{Host: "host", Message: "output"})
+	if err != nil {
+		t.Fatalf("Error encoding: %s", err)
+	}
+	enc := newEncryption(info.EncryptionMethod, iv, info.Password)
+	if _, err := decodeDataPacket(b, enc); !errors.Is(err, ErrCRCMismatch) {
+		t.Errorf("Expected ErrCRCMismatch with the standard CRC32, got %v", err)
+	}
+	p, err := decodeDataPacketCRC(b, enc, crc)
+	if err != nil || p.hostName != "host" || p.pluginOutput != "output" {
+		t.Errorf("Bad packet %+v: %v", p, err)
+	}
+}
+
+func benchmarkEncode(b *testing.B, method int) {
+	iv := make([]byte, InitIVLength)
+	rand.Read(iv)
+	e, err := NewEncoder(ServerInfo{EncryptionMethod: method, Password: "password"}, iv, 1234)
+	if err != nil {
+		b.Fatalf("Error creating encoder: %s", err)
+	}
+	m := &Message{State: STATE_OK, Host: "host", Service: "service", Message: "A plugin message"}
+	b.SetBytes(DataPacketSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := e.Encode(m)
+		if err != nil {
+			b.Fatalf("Error encoding: %s", err)
+		}
+	}
+}
+
+func BenchmarkEncodeNone(b *testing.B)        { benchmarkEncode(b, ENCRYPT_NONE) }
+func BenchmarkEncodeXOR(b *testing.B)         { benchmarkEncode(b, ENCRYPT_XOR) }
+func BenchmarkEncodeRijndael256(b *testing.B) { benchmarkEncode(b, ENCRYPT_RIJNDAEL256) }
+
+// BenchmarkEncodeKeySetup includes setting up the encryption for every packet, as happens
+// once per connection.
+func BenchmarkEncodeKeySetup(b *testing.B) {
+	iv := make([]byte, InitIVLength)
+	rand.Read(iv)
+	info := ServerInfo{EncryptionMethod: ENCRYPT_RIJNDAEL256, Password: "password"}
+	m := &Message{State: STATE_OK, Host: "host", Service: "service", Message: "A plugin message"}
+	for i := 0; i < b.N; i++ {
+		_, err := EncodePacket(info, iv, 1234, m)
+		if err != nil {
+			b.Fatalf("Error encoding: %s", err)
+		}
+	}
+}
+
+func TestParseEncryptionMethod(t *testing.T) {
+	for name, expected := range map[string]int{
+		"none":         ENCRYPT_NONE,
+		"XOR":          ENCRYPT_XOR,
+		"rijndael-256": ENCRYPT_RIJNDAEL256,
+		"aes128":       ENCRYPT_RIJNDAEL128,
+		"AES-192":      ENCRYPT_RIJNDAEL192,
+		"3":            ENCRYPT_3DES,
+		"blowfish":     ENCRYPT_BLOWFISH,
+		"tripledes":    ENCRYPT_3DES,
+		"3des":         ENCRYPT_3DES,
+	} {
+		method, err := ParseEncryptionMethod(name)
+		if err != nil || method != expected {
+			t.Errorf("ParseEncryptionMethod(%q): expected %d, got %d, %v", name, expected, method, err)
+		}
+	}
+	// every method's name and number, as written in a config file, parse back to it
+	for method, name := range encryptionNames {
+		for _, s := range []string{name, strconv.Itoa(method)} {
+			if m, err := ParseEncryptionMethod(s); err != nil || m != method {
+				t.Errorf("ParseEncryptionMethod(%q): expected %d, got %d, %v", s, method, m, err)
+			}
+		}
+	}
+	for _, name := range []string{"", "rot13", "99"} {
+		if _, err := ParseEncryptionMethod(name); err == nil {
+			t.Errorf("ParseEncryptionMethod(%q) did not fail", name)
+		}
+	}
+}
+
+// limitedWriter accepts limit bytes, then fails.
+type limitedWriter struct {
+	limit int
+	err   error
+}
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	if len(b) <= w.limit {
+		w.limit -= len(b)
+		return len(b), nil
+	}
+	n := w.limit
+	w.limit = 0
+	return n, w.err
+}
+
+func TestShortWrite(t *testing.T) {
+	b := make([]byte, DataPacketSize)
+	if err := writePacket(&limitedWriter{limit: DataPacketSize}, b); err != nil {
+		t.Errorf("Error writing a whole packet: %s", err)
+	}
+	reset := errors.New("connection reset")
+	err := writePacket(&limitedWriter{limit: 100, err: reset}, b)
+	if !errors.Is(err, ErrShortWrite) || !errors.Is(err, reset) {
+		t.Errorf("Expected ErrShortWrite wrapping the write error, got %v", err)
+	}
+	err = writePacket(&limitedWriter{limit: 100}, b)
+	if !errors.Is(err, ErrShortWrite) || !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("Expected ErrShortWrite for a short write without an error, got %v", err)
+	}
+	if err := writePacket(&limitedWriter{err: reset}, b); err != reset {
+		t.Errorf("Expected the plain error when nothing was written, got %v", err)
+	}
+
+	// batches report a short write when their buffer is flushed
+	for _, send := range []func(*NSCAServer, []*Message) error{
+		(*NSCAServer).SendBatch,
+		func(n *NSCAServer, messages []*Message) error {
+			c := make(chan *Message, len(messages))
+			for _, m := range messages {
+				c <- m
+			}
+			close(c)
+			return n.SendStream(c)
+		},
+	} {
+		client, server := net.Pipe()
+		go server.Write(make([]byte, InitPacketSize))
+		n := new(NSCAServer)
+		if err := n.handshake(client, ServerInfo{}); err != nil {
+			t.Fatalf("Handshake failed: %s", err)
+		}
+		// the connection takes the first packet and part of the second
+		n.conn = shortConn{client, &limitedWriter{limit: DataPacketSize + 100}}
+		err = send(n, []*Message{{Host: "a"}, {Host: "b"}})
+		if !errors.Is(err, ErrShortWrite) {
+			t.Errorf("Expected ErrShortWrite from a batch, got %v", err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// writeSizes records the size of each write.
+type writeSizes []int
+
+func (w *writeSizes) Write(b []byte) (int, error) {
+	*w = append(*w, len(b))
+	return len(b), nil
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go server.Write(make([]byte, InitPacketSize))
+	n := new(NSCAServer)
+	if err := n.handshake(client, ServerInfo{MaxBatchSize: 3}); err != nil {
+		t.Fatalf("Handshake failed: %s", err)
+	}
+	defer n.Close()
+	var writes writeSizes
+	n.conn = shortConn{client, &writes}
+	messages := make([]*Message, 7)
+	for i := range messages {
+		messages[i] = &Message{Host: "host"}
+	}
+	if err := n.SendBatch(messages); err != nil {
+		t.Fatalf("Error sending batch: %s", err)
+	}
+	// the batch is flushed every 3 messages, then at its end
+	if len(writes) != 3 || writes[0] != 3*DataPacketSize || writes[1] != 3*DataPacketSize || writes[2] != DataPacketSize {
+		t.Errorf("Expected writes of 3, 3 and 1 packets, got %v bytes", writes)
+	}
+}
+
+// shortConn is a connection whose writes go to w.
+type shortConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c shortConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
@@ -0,0 +1,151 @@
+package nsca
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidPerfData is returned, wrapped with the offending item, by ParsePerfData for
+// performance data that does not follow the Nagios plugin format.
+var ErrInvalidPerfData = errors.New("Invalid performance data")
+
+// PerfMetric is one item of Nagios performance data, 'label'=value[UOM];[warn];[crit];[min];[max].
+type PerfMetric struct {
+	// Label is the name of the metric, with any quoting removed.
+	Label string
+	// Value is the measured value, or NaN if the plugin reported it as "U" (undetermined).
+	Value float64
+	// Unit is the unit of measurement, such as "s", "%", "B" or "c", or "" if there is none.
+	Unit string
+	// Warn and Crit are the warning and critical thresholds in the plugin range format
+	// (for example "10", "10:20" or "@~:5"), or "" if not given.
+	Warn, Crit string
+	// Min and Max are the bounds of the value, or NaN if not given.
+	Min, Max float64
+}
+
+// ParsePerfData splits plugin output, such as the Message of a decoded packet, into its
+// text and its performance data, as laid out by the Nagios plugin API. Performance data
+// follows the first "|" of the first line and, for multi-line output, the first "|" of
+// the long output after it, where it takes up the rest of the output, later lines
+// included; text holds everything else, with the long output lines joined by newlines.
+// If an item cannot be parsed,
+// ParsePerfData returns the text, the metrics before it and an error wrapping
+// ErrInvalidPerfData.
+func ParsePerfData(output string) (text string, metrics []PerfMetric, err error) {
+	var texts, perf []string
+	first, long, _ := strings.Cut(output, "\n")
+	if j := strings.IndexByte(first, '|'); j >= 0 {
+		perf = append(perf, first[j+1:])
+		first = first[:j]
+	}
+	texts = append(texts, strings.TrimRight(first, " "))
+	if long != "" {
+		// the long output is text up to its first "|" and performance data after it,
+		// over any number of lines
+		long, longPerf, found := strings.Cut(long, "|")
+		texts = append(texts, strings.Split(long, "\n")...)
+		if found {
+			perf = append(perf, strings.Split(longPerf, "\n")...)
+		}
+	}
+	// a long output section with no text of its own leaves an empty last line
+	if n := len(texts); n > 1 && texts[n-1] == "" {
+		texts = texts[:n-1]
+	}
+	text = strings.Join(texts, "\n")
+	for _, section := range perf {
+		items, err := splitPerfData(section)
+		if err != nil {
+			return text, metrics, err
+		}
+		for _, item := range items {
+			m, err := parsePerfMetric(item)
+			if err != nil {
+				return text, metrics, err
+			}
+			metrics = append(metrics, m)
+		}
+	}
+	return text, metrics, nil
+}
+
+// splitPerfData splits a performance data section on spaces outside quoted labels.
+func splitPerfData(s string) ([]string, error) {
+	var items []string
+	var item strings.Builder
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == ' ' && !quoted:
+			if item.Len() > 0 {
+				items = append(items, item.String())
+				item.Reset()
+			}
+			continue
+		}
+		item.WriteByte(c)
+	}
+	if quoted {
+		return nil, fmt.Errorf("%w: unterminated label in %q", ErrInvalidPerfData, s)
+	}
+	if item.Len() > 0 {
+		items = append(items, item.String())
+	}
+	return items, nil
+}
+
+// parsePerfMetric parses a single 'label'=value[UOM];[warn];[crit];[min];[max] item.
+func parsePerfMetric(item string) (PerfMetric, error) {
+	m := PerfMetric{Min: math.NaN(), Max: math.NaN()}
+	eq := strings.LastIndexByte(item, '=')
+	if eq <= 0 {
+		return m, fmt.Errorf("%w: %q has no label", ErrInvalidPerfData, item)
+	}
+	m.Label = item[:eq]
+	if len(m.Label) >= 2 && m.Label[0] == '\'' && m.Label[len(m.Label)-1] == '\'' {
+		m.Label = strings.ReplaceAll(m.Label[1:len(m.Label)-1], "''", "'")
+	}
+	fields := strings.Split(item[eq+1:], ";")
+	if len(fields) > 5 {
+		return m, fmt.Errorf("%w: %q has too many fields", ErrInvalidPerfData, item)
+	}
+	value := fields[0]
+	if value == "U" {
+		m.Value = math.NaN()
+	} else {
+		end := strings.IndexFunc(value, func(r rune) bool {
+			return !strings.ContainsRune("0123456789.-+eE", r)
+		})
+		if end < 0 {
+			end = len(value)
+		}
+		v, err := strconv.ParseFloat(value[:end], 64)
+		if err != nil {
+			return m, fmt.Errorf("%w: %q has a bad value", ErrInvalidPerfData, item)
+		}
+		m.Value, m.Unit = v, value[end:]
+	}
+	bounds := []*float64{&m.Min, &m.Max}
+	for i, field := range fields[1:] {
+		switch {
+		case i == 0:
+			m.Warn = field
+		case i == 1:
+			m.Crit = field
+		case field != "":
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return m, fmt.Errorf("%w: %q has a bad minimum or maximum", ErrInvalidPerfData, item)
+			}
+			*bounds[i-2] = v
+		}
+	}
+	return m, nil
+}
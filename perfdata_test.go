@@ -0,0 +1,60 @@
+package nsca
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParsePerfData(t *testing.T) {
+	text, metrics, err := ParsePerfData("DISK OK - free space: / 3326 MB | /=2643MB;5948;5958;0;5968 'free space'=91%;;;;\n" +
+		"/ 15272 MB (77%);\n/boot 68 MB (69%); | /boot=68MB;88;93;0;98\nload=U")
+	if err != nil {
+		t.Fatalf("Error parsing perf data: %s", err)
+	}
+	if text != "DISK OK - free space: / 3326 MB\n/ 15272 MB (77%);\n/boot 68 MB (69%); " {
+		t.Errorf("Bad text %q", text)
+	}
+	if len(metrics) != 4 {
+		t.Fatalf("Expected 4 metrics, got %+v", metrics)
+	}
+	root := metrics[0]
+	if root.Label != "/" || root.Value != 2643 || root.Unit != "MB" || root.Warn != "5948" ||
+		root.Crit != "5958" || root.Min != 0 || root.Max != 5968 {
+		t.Errorf("Bad metric %+v", root)
+	}
+	free := metrics[1]
+	if free.Label != "free space" || free.Value != 91 || free.Unit != "%" || free.Warn != "" ||
+		!math.IsNaN(free.Min) || !math.IsNaN(free.Max) {
+		t.Errorf("Bad metric %+v", free)
+	}
+	if metrics[2].Label != "/boot" || metrics[2].Max != 98 {
+		t.Errorf("Bad metric %+v", metrics[2])
+	}
+	// performance data in the long output runs to its end
+	if metrics[3].Label != "load" || !math.IsNaN(metrics[3].Value) {
+		t.Errorf("Bad metric %+v", metrics[3])
+	}
+
+	_, metrics, err = ParsePerfData("OK | time=0.5s;@1:2;~:10 rate=U;;;0 'it''s'=-1.5e3c")
+	if err != nil {
+		t.Fatalf("Error parsing perf data: %s", err)
+	}
+	if len(metrics) != 3 || metrics[0].Warn != "@1:2" || metrics[0].Crit != "~:10" || metrics[0].Unit != "s" ||
+		!math.IsNaN(metrics[1].Value) || metrics[1].Min != 0 || !math.IsNaN(metrics[1].Max) || metrics[2].Label != "it's" ||
+		metrics[2].Value != -1500 || metrics[2].Unit != "c" {
+		t.Errorf("Bad metrics %+v", metrics)
+	}
+
+	text, metrics, err = ParsePerfData("no perf data here")
+	if err != nil || text != "no perf data here" || metrics != nil {
+		t.Errorf("Unexpected result %q, %v, %v", text, metrics, err)
+	}
+
+	for _, bad := range []string{"OK | =1", "OK | a=x", "OK | 'a=1", "OK | a=1;2;3;four", "OK | a=1;2;3;4;5;6"} {
+		_, _, err = ParsePerfData(bad)
+		if !errors.Is(err, ErrInvalidPerfData) {
+			t.Errorf("%q: expected ErrInvalidPerfData, got %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package nsca
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// queueCheckpointFile is the name of the checkpoint in ServerInfo.PersistQueueDir.
+const queueCheckpointFile = "queue.json"
+
+// queueCheckpointInterval is how often a changed checkpoint is written.
+const queueCheckpointInterval = time.Second
+
+// queueCheckpoint tracks the messages submitted to an Endpoint whose result has not
+// been reported yet, and writes them to PersistQueueDir.
+type queueCheckpoint struct {
+	dir string
+
+	mu      sync.Mutex // guards the fields below
+	seq     uint64
+	pending map[*Message][]pendingRecord
+	dirty   bool
+}
+
+// pendingRecord is one submission of a pending message, in submission order.
+type pendingRecord struct {
+	seq    uint64
+	record spoolRecord
+}
+
+func newQueueCheckpoint(dir string) *queueCheckpoint {
+	return &queueCheckpoint{dir: dir, pending: make(map[*Message][]pendingRecord)}
+}
+
+// add records that m is pending. It is safe to call on a nil checkpoint.
+func (c *queueCheckpoint) add(m *Message) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	c.pending[m] = append(c.pending[m], pendingRecord{c.seq, newSpoolRecord(m)})
+	c.dirty = true
+}
+
+// remove records that the result of the oldest submission of m has been reported. It is
+// safe to call on a nil checkpoint.
+func (c *queueCheckpoint) remove(m *Message) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	records, ok := c.pending[m]
+	if !ok {
+		return
+	}
+	if len(records) == 1 {
+		delete(c.pending, m)
+	} else {
+		c.pending[m] = records[1:]
+	}
+	c.dirty = true
+}
+
+// write saves the pending messages, oldest first, if they changed since the last write.
+// An empty checkpoint is removed rather than written.
+func (c *queueCheckpoint) write() error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	var all []pendingRecord
+	for _, records := range c.pending {
+		all = append(all, records...)
+	}
+	c.dirty = false
+	c.mu.Unlock()
+	path := filepath.Join(c.dir, queueCheckpointFile)
+	if len(all) == 0 {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].seq < all[j].seq })
+	records := make([]spoolRecord, len(all))
+	for i, p := range all {
+		records[i] = p.record
+	}
+	b, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(c.dir, 0700)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// run writes the checkpoint every queueCheckpointInterval until stop is closed.
+func (c *queueCheckpoint) run(info ServerInfo, stop <-chan struct{}) {
+	tick, stopTicker := info.ticker(queueCheckpointInterval)
+	defer stopTicker()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick:
+			if err := c.write(); err != nil {
+				info.logf("Could not checkpoint NSCA queue: %s", err)
+			}
+		}
+	}
+}
+
+// load reads the messages left in the checkpoint by a previous process and marks them
+// pending. A missing checkpoint is not an error.
+func (c *queueCheckpoint) load() ([]*Message, error) {
+	b, err := os.ReadFile(filepath.Join(c.dir, queueCheckpointFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []spoolRecord
+	err = json.Unmarshal(b, &records)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*Message, len(records))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, r := range records {
+		messages[i] = r.message()
+		c.seq++
+		c.pending[messages[i]] = []pendingRecord{{c.seq, r}}
+	}
+	return messages, nil
+}
@@ -0,0 +1,56 @@
+package nsca
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPersistQueue(t *testing.T) {
+	dir := t.TempDir()
+	// leave a checkpoint behind as a crashed process would
+	crashed := newQueueCheckpoint(dir)
+	sent := &Message{State: STATE_OK, Host: "host", Service: "sent"}
+	crashed.add(sent)
+	crashed.add(&Message{State: STATE_WARNING, Host: "host", Service: "first", Message: "one"})
+	crashed.add(&Message{State: STATE_CRITICAL, Host: "host", Service: "second", Message: "two"})
+	crashed.remove(sent)
+	if err := crashed.write(); err != nil {
+		t.Fatalf("Error writing checkpoint: %s", err)
+	}
+
+	path, received := unixServer(t)
+	var results []string
+	e := StartEndpoint(ServerInfo{
+		Network:         "unix",
+		Host:            path,
+		PersistQueueDir: dir,
+		OnResult: func(m *Message, err error) {
+			if err != nil {
+				t.Errorf("Error sending %s: %s", m.Service, err)
+			}
+			results = append(results, m.Service)
+		},
+	}, 1)
+	if err := e.Submit(&Message{State: STATE_OK, Host: "host", Service: "new"}); err != nil {
+		t.Fatalf("Error submitting: %s", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Error closing endpoint: %s", err)
+	}
+	if len(results) != 3 || results[0] != "first" || results[1] != "second" || results[2] != "new" {
+		t.Errorf("Expected the restored messages first, got %v", results)
+	}
+	enc := newEncryption(ENCRYPT_NONE, make([]byte, 128), "")
+	b := <-received
+	if len(b) != 3*720 {
+		t.Fatalf("Expected 3 packets, got %d bytes", len(b))
+	}
+	p, err := decodeDataPacket(b[:720], enc)
+	if err != nil || p.returnCode != STATE_WARNING || p.pluginOutput != "one" {
+		t.Errorf("Bad restored packet %+v: %v", p, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, queueCheckpointFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected the drained checkpoint to be removed, got %v", err)
+	}
+}
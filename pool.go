@@ -0,0 +1,337 @@
+package nsca
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPoolClosed is returned by NSCAPool.Send after the pool has been closed.
+var ErrPoolClosed = errors.New("NSCA pool is closed")
+
+// PoolConfig contains the configuration of an NSCAPool.
+type PoolConfig struct {
+	// Server is the NSCA server that every connection in the pool connects to.
+	Server ServerInfo
+	// Size is the number of connections in the pool. It defaults to 1.
+	Size int
+	// MaxConnAge, if set, retires each connection once it has been open this long, so the
+	// pool picks up DNS and backend changes instead of staying pinned to the servers it
+	// first reached. An expired connection is replaced in the background after the send
+	// that noticed its age, and is kept out of rotation meanwhile, so no send waits for
+	// the reconnect. If the replacement fails, the next send through it connects again.
+	MaxConnAge time.Duration
+}
+
+// NSCAPool sends messages over a fixed number of connections to an NSCA server. Unlike
+// NSCAServer, it is safe to use from multiple threads. Connections are made lazily and
+// re-made after errors.
+type NSCAPool struct {
+	config   PoolConfig
+	conns    []*poolConn
+	idle     chan *poolConn
+	sem      chan struct{} // nil unless Server.MaxConcurrentSends is below Size
+	prepared atomic.Pointer[preparedServer]
+	done     chan struct{}
+	ctx      context.Context // cancelled by Close, for reconnects in the background
+	cancel   context.CancelFunc
+	close    sync.Once
+	inFlight int64
+}
+
+// preparedServer is the work done once by NSCAPool.Prepare for every connection.
+type preparedServer struct {
+	info  ServerInfo   // Server with Host resolved to an address
+	block cipher.Block // the keyed block cipher, nil for ENCRYPT_NONE and ENCRYPT_XOR
+}
+
+// poolConn is a single connection in a pool and its counters.
+type poolConn struct {
+	server NSCAServer
+	conn   net.Conn  // last connection seen, to notice when it is replaced
+	opened time.Time // when conn was opened
+
+	mu       sync.Mutex // guards the fields below
+	sends    uint64
+	failures uint64
+	lastErr  error
+	state    ConnState
+}
+
+// ConnStats contains the counters of a single pooled connection.
+type ConnStats struct {
+	// Sends is the number of messages sent successfully.
+	Sends uint64
+	// Failures is the number of failed connection or send attempts.
+	Failures uint64
+	// LastError is the most recent error, or nil if there has not been one.
+	LastError error
+	// State is Connected if the connection is open and Disconnected otherwise.
+	State ConnState
+}
+
+// PoolStats is a snapshot of the state of an NSCAPool.
+type PoolStats struct {
+	// Conns contains the counters of each connection in the pool.
+	Conns []ConnStats
+	// InFlight is the number of sends in progress.
+	InFlight int
+}
+
+// NewPool creates an NSCAPool. No connections are made until the first message is sent.
+func NewPool(config PoolConfig) *NSCAPool {
+	if config.Size <= 0 {
+		config.Size = 1
+	}
+	p := &NSCAPool{
+		config: config,
+		conns:  make([]*poolConn, config.Size),
+		idle:   make(chan *poolConn, config.Size),
+		done:   make(chan struct{}),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	if n := config.Server.MaxConcurrentSends; n > 0 && n < config.Size {
+		p.sem = make(chan struct{}, n)
+	}
+	for i := range p.conns {
+		p.conns[i] = &poolConn{state: Disconnected}
+		p.idle <- p.conns[i]
+	}
+	return p
+}
+
+// Send sends a message over the next idle connection, waiting for one if they are all
+// busy or ServerInfo.MaxConcurrentSends are already in progress. The Status channel of
+// the message is not used.
+func (p *NSCAPool) Send(m *Message) error {
+	select {
+	case <-p.done:
+		return ErrPoolClosed
+	default:
+	}
+	if p.sem != nil {
+		select {
+		case p.sem <- struct{}{}:
+		case <-p.done:
+			return ErrPoolClosed
+		}
+		defer func() { <-p.sem }()
+	}
+	var c *poolConn
+	select {
+	case c = <-p.idle:
+	case <-p.done:
+		return ErrPoolClosed
+	}
+	atomic.AddInt64(&p.inFlight, 1)
+	err := c.send(p.server(c), m)
+	atomic.AddInt64(&p.inFlight, -1)
+	if p.config.MaxConnAge > 0 && c.conn != nil && p.config.Server.now().Sub(c.opened) >= p.config.MaxConnAge {
+		go p.recycle(c)
+		return err
+	}
+	p.idle <- c
+	return err
+}
+
+// recycle replaces a connection that has reached MaxConnAge and returns it to the pool.
+// Once the pool is closing, the connection is returned closed instead.
+func (p *NSCAPool) recycle(c *poolConn) {
+	c.server.Close()
+	c.setState(Disconnected)
+	select {
+	case <-p.done:
+	default:
+		err := c.server.connect(p.ctx, p.server(c))
+		c.record(err, false)
+		c.track(p.config.Server)
+	}
+	p.idle <- c
+}
+
+// Warm connects every connection in the pool that is not already connected, in parallel,
+// so that misconfiguration surfaces immediately and the first sends do not pay for the
+// handshake. It returns the errors of the connections that failed, joined, or the context's
+// error if ctx ends while waiting for a busy connection. With the NRDP transport there is
+// nothing to connect, and Warm returns nil.
+func (p *NSCAPool) Warm(ctx context.Context) error {
+	if p.config.Server.Transport == NRDP {
+		// nothing to connect
+		return nil
+	}
+	// hold every connection until all of them are done, so each is warmed exactly once
+	held := make(chan *poolConn, len(p.conns))
+	errs := make([]error, len(p.conns))
+	var wg sync.WaitGroup
+	for i := range p.conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var c *poolConn
+			select {
+			case c = <-p.idle:
+			case <-p.done:
+				errs[i] = ErrPoolClosed
+				return
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			held <- c
+			if c.server.conn != nil {
+				return
+			}
+			errs[i] = contextError(ctx, c.server.connect(ctx, p.server(c)))
+			c.record(errs[i], false)
+			c.track(p.config.Server)
+		}(i)
+	}
+	wg.Wait()
+	close(held)
+	for c := range held {
+		p.idle <- c
+	}
+	return errors.Join(errs...)
+}
+
+// Prepare does the work that every connection would otherwise repeat on its first
+// connect, once for the whole pool: it resolves Server.Host to an address, and derives
+// the cipher key from the password and expands it into the block cipher's key schedule.
+// Connections made afterwards dial the resolved address and share the keyed cipher.
+//
+// Only what does not depend on the session is shared. The key schedule is a function of
+// the password alone and the block ciphers are safe for concurrent use, while each
+// connection still runs its own handshake and so encrypts with its own server-chosen IV,
+// timestamp and block mode state, exactly as without Prepare. The XOR method has no key
+// schedule to share.
+//
+// The address is resolved once, so the pool no longer follows DNS changes; with
+// MaxConnAge, call Prepare again from time to time to pick them up. It is not resolved
+// for the unix network, TLS when TLSConfig.ServerName is empty (the name is then needed
+// for the certificate), ParallelDial, DryRun or the NRDP transport. Connections already
+// open are not affected. Prepare returns an error, and leaves the pool unprepared, if
+// the host cannot be resolved or the cipher cannot be set up.
+func (p *NSCAPool) Prepare(ctx context.Context) error {
+	info := p.config.Server
+	pr := &preparedServer{info: info}
+	if info.Transport == NSCA && !info.DryRun && !info.ParallelDial && info.network() != "unix" &&
+		registeredTransport(info.network()) == nil && info.Host != "" && net.ParseIP(info.Host) == nil &&
+		(info.TLSConfig == nil || info.TLSConfig.ServerName != "") {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, info.Host)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+		network := info.network()
+		for _, addr := range addrs {
+			is4 := addr.IP.To4() != nil
+			if (network == "tcp4" && !is4) || (network == "tcp6" && is4) {
+				continue
+			}
+			pr.info.Host = addr.String()
+			break
+		}
+		if pr.info.Host == info.Host {
+			return &net.AddrError{Err: "no suitable address found", Addr: info.Host}
+		}
+	}
+	if info.Transport == NSCA && info.EncryptionMethod != ENCRYPT_NONE && info.EncryptionMethod != ENCRYPT_XOR {
+		keyed, err := info.readPasswordFile()
+		if err != nil {
+			return err
+		}
+		e := newEncryption(keyed.EncryptionMethod, nil, keyed.Password)
+		e.keyDeriver = keyed.KeyDeriver
+		err = e.prepare()
+		pr.block = e.block
+		e.wipe()
+		if err != nil {
+			return err
+		}
+	}
+	p.prepared.Store(pr)
+	return nil
+}
+
+// server returns the settings to connect c with, sharing the cipher from Prepare with it.
+// It must only be called while c is held.
+func (p *NSCAPool) server(c *poolConn) ServerInfo {
+	pr := p.prepared.Load()
+	if pr == nil {
+		return p.config.Server
+	}
+	c.server.sharedBlock = pr.block
+	return pr.info
+}
+
+// Close waits for sends in progress to finish and closes every connection in the pool.
+func (p *NSCAPool) Close() {
+	p.close.Do(func() {
+		close(p.done)
+		p.cancel()
+		for range p.conns {
+			c := <-p.idle
+			c.server.Close()
+			c.setState(Disconnected)
+		}
+	})
+}
+
+// PoolStats returns the counters of every connection in the pool.
+func (p *NSCAPool) PoolStats() PoolStats {
+	stats := PoolStats{
+		Conns:    make([]ConnStats, len(p.conns)),
+		InFlight: int(atomic.LoadInt64(&p.inFlight)),
+	}
+	for i, c := range p.conns {
+		c.mu.Lock()
+		stats.Conns[i] = ConnStats{
+			Sends:     c.sends,
+			Failures:  c.failures,
+			LastError: c.lastErr,
+			State:     c.state,
+		}
+		c.mu.Unlock()
+	}
+	return stats
+}
+
+func (c *poolConn) send(info ServerInfo, m *Message) error {
+	err := c.server.sendReconnecting(info, m)
+	c.record(err, true)
+	c.track(info)
+	return err
+}
+
+// track notes when the current connection was opened, if it is a new one.
+func (c *poolConn) track(info ServerInfo) {
+	if c.server.conn != c.conn {
+		c.conn = c.server.conn
+		c.opened = info.now()
+	}
+}
+
+// record updates the counters after a connection or send attempt.
+func (c *poolConn) record(err error, sent bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.failures++
+		c.lastErr = err
+		c.state = Disconnected
+		return
+	}
+	if sent {
+		c.sends++
+	}
+	c.state = Connected
+}
+
+func (c *poolConn) setState(state ConnState) {
+	c.mu.Lock()
+	c.state = state
+	c.mu.Unlock()
+}
@@ -0,0 +1,241 @@
+package nsca
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	path, received := unixServer(t)
+	p := NewPool(PoolConfig{Server: ServerInfo{Network: "unix", Host: path}, Size: 3})
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.Send(&Message{State: STATE_OK, Host: "host"})
+			if err != nil {
+				t.Errorf("Error sending through pool: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	stats := p.PoolStats()
+	if len(stats.Conns) != 3 || stats.InFlight != 0 {
+		t.Fatalf("Bad stats: %+v", stats)
+	}
+	var sends uint64
+	for _, c := range stats.Conns {
+		sends += c.Sends
+		if c.Failures != 0 || c.LastError != nil {
+			t.Errorf("Unexpected failures: %+v", c)
+		}
+	}
+	if sends != 30 {
+		t.Errorf("Expected 30 sends, got %d", sends)
+	}
+	p.Close()
+	if err := p.Send(&Message{Host: "host"}); err != ErrPoolClosed {
+		t.Errorf("Expected ErrPoolClosed, got %v", err)
+	}
+	// each connection's bytes arrive once it is closed
+	total := 0
+	for total < 30*720 {
+		select {
+		case b := <-received:
+			total += len(b)
+		case <-time.After(time.Second):
+			t.Fatalf("Server received %d bytes, expected %d", total, 30*720)
+		}
+	}
+}
+
+func TestPoolWarm(t *testing.T) {
+	path, _ := unixServer(t)
+	p := NewPool(PoolConfig{Server: ServerInfo{Network: "unix", Host: path}, Size: 4})
+	defer p.Close()
+	err := p.Warm(context.Background())
+	if err != nil {
+		t.Fatalf("Error warming pool: %s", err)
+	}
+	for i, c := range p.PoolStats().Conns {
+		if c.State != Connected {
+			t.Errorf("Connection %d not connected after Warm: %+v", i, c)
+		}
+	}
+
+	bad := NewPool(PoolConfig{Server: ServerInfo{Network: "unix", Host: path + ".missing"}, Size: 2})
+	defer bad.Close()
+	err = bad.Warm(context.Background())
+	if err == nil {
+		t.Fatalf("Warm should have failed")
+	}
+	for i, c := range bad.PoolStats().Conns {
+		if c.Failures != 1 || c.State != Disconnected {
+			t.Errorf("Connection %d: expected one failure, got %+v", i, c)
+		}
+	}
+}
+
+func TestPoolMaxConcurrentSends(t *testing.T) {
+	path, _ := unixServer(t)
+	p := NewPool(PoolConfig{Server: ServerInfo{Network: "unix", Host: path, MaxConcurrentSends: 2}, Size: 5})
+	defer p.Close()
+	var mu sync.Mutex
+	running, peak := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.Send(&Message{State: STATE_OK, Host: "host"})
+			if err != nil {
+				t.Errorf("Error sending through pool: %s", err)
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mu.Lock()
+			running = p.PoolStats().InFlight
+			if running > peak {
+				peak = running
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if peak > 2 {
+		t.Errorf("Expected at most 2 sends in flight, saw %d", peak)
+	}
+	if cap(p.sem) != 2 {
+		t.Errorf("Expected a semaphore of 2, got %d", cap(p.sem))
+	}
+	if NewPool(PoolConfig{Server: ServerInfo{MaxConcurrentSends: 5}, Size: 3}).sem != nil {
+		t.Errorf("A limit at or above Size should not add a semaphore")
+	}
+}
+
+func TestPoolMaxConnAge(t *testing.T) {
+	path, received := unixServer(t)
+	p := NewPool(PoolConfig{Server: ServerInfo{Network: "unix", Host: path}, Size: 1, MaxConnAge: 20 * time.Millisecond})
+	for i := 0; i < 2; i++ {
+		if err := p.Send(&Message{State: STATE_OK, Host: "host"}); err != nil {
+			t.Fatalf("Error sending through pool: %s", err)
+		}
+	}
+	first := p.conns[0].conn
+	time.Sleep(30 * time.Millisecond)
+	// this send finds the connection expired and recycles it afterwards
+	if err := p.Send(&Message{State: STATE_OK, Host: "host"}); err != nil {
+		t.Fatalf("Error sending through pool: %s", err)
+	}
+	// the old connection is closed by the recycle, so its packets arrive
+	select {
+	case b := <-received:
+		if len(b) != 3*720 {
+			t.Errorf("Expected 3 packets on the old connection, got %d bytes", len(b))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expired connection was not closed")
+	}
+	if err := p.Send(&Message{State: STATE_OK, Host: "host"}); err != nil {
+		t.Fatalf("Error sending through pool: %s", err)
+	}
+	if c := p.conns[0]; c.conn == nil || c.conn == first {
+		t.Errorf("Expected a replacement connection")
+	}
+	stats := p.PoolStats()
+	if stats.Conns[0].Sends != 4 || stats.Conns[0].Failures != 0 {
+		t.Errorf("Bad stats: %+v", stats.Conns[0])
+	}
+	p.Close()
+}
+
+func TestPoolCloseDuringRecycle(t *testing.T) {
+	// the first connection is served, later ones never get an initialization packet
+	path := t.TempDir() + "/nsca.sock"
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if i == 0 {
+				conn.Write(make([]byte, 132))
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	p := NewPool(PoolConfig{Server: ServerInfo{Network: "unix", Host: path}, Size: 1, MaxConnAge: time.Nanosecond})
+	if err := p.Send(&Message{State: STATE_OK, Host: "host"}); err != nil {
+		t.Fatalf("Error sending through pool: %s", err)
+	}
+	// the recycle is stuck in a handshake with no timeout
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Close waited for the recycled connection's handshake")
+	}
+}
+
+func TestPoolPrepare(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(make([]byte, InitPacketSize))
+		b, _ := io.ReadAll(conn)
+		received <- b
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	info := ServerInfo{Network: "tcp4", Host: "localhost", Port: port, EncryptionMethod: ENCRYPT_RIJNDAEL256, Password: "password"}
+	p := NewPool(PoolConfig{Server: info})
+	if err := p.Prepare(context.Background()); err != nil {
+		t.Fatalf("Error preparing pool: %s", err)
+	}
+	pr := p.prepared.Load()
+	if pr.info.Host != "127.0.0.1" || pr.block == nil {
+		t.Fatalf("Expected a resolved host and a keyed cipher, got %q, %v", pr.info.Host, pr.block)
+	}
+	m := &Message{State: STATE_OK, Host: "host", Message: "prepared"}
+	if err := p.Send(m); err != nil {
+		t.Fatalf("Error sending through prepared pool: %s", err)
+	}
+	p.Close()
+	packet, err := decodeDataPacket(<-received, newEncryption(info.EncryptionMethod, make([]byte, InitIVLength), info.Password))
+	if err != nil || packet.pluginOutput != "prepared" {
+		t.Errorf("Packet from shared cipher does not decode: %+v, %v", packet, err)
+	}
+
+	bad := NewPool(PoolConfig{Server: ServerInfo{EncryptionMethod: ENCRYPT_RIJNDAEL128, Password: "password",
+		KeyDeriver: func(string, int) []byte { return []byte{1} }}})
+	if err := bad.Prepare(context.Background()); !errors.Is(err, ErrEncryptionSetup) || bad.prepared.Load() != nil {
+		t.Errorf("Expected ErrEncryptionSetup and no prepared state, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package nsca
+
+import (
+	"container/heap"
+)
+
+// queueItem is a message waiting in an endpoint's priority queue.
+type queueItem struct {
+	m     *Message
+	seq   uint64 // arrival order, to keep equal priorities FIFO
+	index int    // position in the heap
+}
+
+// priorityQueue is a heap of queued messages, highest priority first.
+type priorityQueue []*queueItem
+
+func (q priorityQueue) Len() int { return len(q) }
+
+func (q priorityQueue) Less(i, j int) bool {
+	if q[i].m.Priority != q[j].m.Priority {
+		return q[i].m.Priority > q[j].m.Priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q priorityQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *priorityQueue) Push(x interface{}) {
+	item := x.(*queueItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *priorityQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
+
+// runPriority is the Run loop used with ServerInfo.PriorityQueue. Every message waiting in
+// the channel is moved into a priority queue before each send, so the highest priority
+// message waiting is always sent next. With CoalesceByService, a queued message is
+// superseded as soon as a newer one for the same host and service arrives. When messages
+// is closed, the queue is sent before returning; when quit is closed, queued messages are
+// discarded without reporting a status.
+func (e *Endpoint) runPriority(quit <-chan interface{}, messages <-chan *Message) {
+	var q priorityQueue
+	var seq uint64
+	latest := make(map[CheckTarget]*queueItem)
+	push := func(m *Message) {
+		e.take(1)
+		key := m.Target()
+		if e.info.CoalesceByService {
+			if old := latest[key]; old != nil {
+				heap.Remove(&q, old.index)
+				e.report(old.m, ErrSuperseded)
+			}
+		}
+		item := &queueItem{m: m, seq: seq}
+		seq++
+		heap.Push(&q, item)
+		latest[key] = item
+	}
+	heartbeat, stop := e.heartbeatTicker()
+	defer stop()
+	keepalive, stopKeepalive := e.keepaliveTicker()
+	defer stopKeepalive()
+	open := true
+	for {
+		if !e.waitResumed(quit) {
+			return
+		}
+		if q.Len() == 0 {
+			if !open {
+				return
+			}
+			select {
+			case <-quit:
+				return
+			case <-e.paused:
+				continue
+			case <-heartbeat:
+				e.applyUpdate()
+				e.sendHeartbeat("")
+				continue
+			case <-keepalive:
+				// only checked while the queue is empty: otherwise it is not idle
+				e.applyUpdate()
+				e.sendKeepalive()
+				continue
+			case <-e.debounce.wait:
+				e.applyUpdate()
+				e.flushDebounced(false)
+				continue
+			case m, ok := <-messages:
+				if !ok {
+					return
+				}
+				push(m)
+			}
+		}
+	waiting:
+		for open {
+			select {
+			case m, ok := <-messages:
+				if !ok {
+					open = false
+					break
+				}
+				push(m)
+			default:
+				break waiting
+			}
+		}
+		select {
+		case <-quit:
+			return
+		case <-heartbeat:
+			// heartbeats go ahead of the backlog
+			e.applyUpdate()
+			e.sendHeartbeat("")
+		case <-e.debounce.wait:
+			e.applyUpdate()
+			e.flushDebounced(false)
+		default:
+		}
+		item := heap.Pop(&q).(*queueItem)
+		key := item.m.Target()
+		if latest[key] == item {
+			delete(latest, key)
+		}
+		e.applyUpdate()
+		e.deliver(item.m)
+	}
+}
@@ -0,0 +1,43 @@
+package nsca
+
+import (
+	"sync"
+)
+
+// SafeServer is an NSCAServer that is safe to use from multiple goroutines. Each call
+// holds a mutex for its whole duration, so calls are serialized: concurrent sends are
+// written one after another on the single connection, never interleaved. The zero
+// value is ready to use.
+type SafeServer struct {
+	mu     sync.Mutex
+	server NSCAServer
+}
+
+// Connect connects to an NSCA server, replacing any existing connection.
+func (s *SafeServer) Connect(connectInfo ServerInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.server.Connect(connectInfo)
+}
+
+// Send sends a message as NSCAServer.Send does.
+func (s *SafeServer) Send(message *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.server.Send(message)
+}
+
+// SendBatch sends messages as NSCAServer.SendBatch does. No other call runs until the
+// whole batch has been written.
+func (s *SafeServer) SendBatch(messages []*Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.server.SendBatch(messages)
+}
+
+// Close closes the connection.
+func (s *SafeServer) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.server.Close()
+}
@@ -0,0 +1,195 @@
+package nsca
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ErrSidecarDelivery is returned by SidecarClient.Send, wrapped with the sidecar's error
+// message, when the sidecar could not deliver a message upstream.
+var ErrSidecarDelivery = errors.New("Sidecar could not deliver message")
+
+// sidecarReply is the sidecar's answer to each message, in JSON after the message's own
+// JSON (a spoolRecord) on the same connection.
+type sidecarReply struct {
+	Error string `json:",omitempty"`
+}
+
+// SidecarServer funnels the messages of every local process on a host through a single
+// upstream connection. It listens on a Unix socket, accepts messages from any number of
+// SidecarClients and submits them to one Endpoint, so the connection, its handshake,
+// backoff, circuit breaker and rate limiting are shared by all of them. Each client
+// waits for the result of its message before sending the next.
+type SidecarServer struct {
+	listener net.Listener
+	endpoint *Endpoint
+
+	mu     sync.Mutex // guards conns and closed
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// StartSidecarServer listens on the Unix socket path and starts an Endpoint for upstream
+// with a queue of queueSize messages, as StartEndpoint does, then serves clients in the
+// background until Close is called. The socket must not exist yet.
+func StartSidecarServer(path string, upstream ServerInfo, queueSize int) (*SidecarServer, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	s := &SidecarServer{
+		listener: l,
+		endpoint: StartEndpoint(upstream, queueSize),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Endpoint returns the Endpoint that sends upstream, for example to change its
+// configuration or look at its Report.
+func (s *SidecarServer) Endpoint() *Endpoint {
+	return s.endpoint
+}
+
+func (s *SidecarServer) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// serve relays the messages of one client until it disconnects.
+func (s *SidecarServer) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var r spoolRecord
+		if dec.Decode(&r) != nil {
+			return
+		}
+		status := make(chan error, 1)
+		m := r.message()
+		m.Status = status
+		err := s.endpoint.Submit(m)
+		if err == nil {
+			err = <-status
+		}
+		var reply sidecarReply
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		if enc.Encode(reply) != nil {
+			return
+		}
+	}
+}
+
+// Close stops accepting clients, delivers the messages already queued, as Endpoint.Close
+// does, and disconnects the clients. It returns the first delivery error that occurred
+// while draining, if any.
+func (s *SidecarServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	s.listener.Close()
+	err := s.endpoint.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// SidecarClient sends messages through a SidecarServer on the same host. It connects on
+// the first Send, and again after an error. It is safe to use from multiple threads, but
+// sends one message at a time.
+type SidecarClient struct {
+	path string
+
+	mu   sync.Mutex // guards the fields below
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+// NewSidecarClient creates a SidecarClient for the sidecar listening on the Unix socket
+// path. No connection is made until the first message is sent.
+func NewSidecarClient(path string) *SidecarClient {
+	return &SidecarClient{path: path}
+}
+
+// Send passes a message to the sidecar and waits for the result of its delivery
+// upstream. It returns an error wrapping ErrSidecarDelivery if the sidecar could not
+// deliver it, or the error talking to the sidecar. The Status channel of the message is
+// not used; only its state, host, service and plugin output are sent.
+func (c *SidecarClient) Send(m *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, err := net.Dial("unix", c.path)
+		if err != nil {
+			return err
+		}
+		c.conn, c.enc, c.dec = conn, json.NewEncoder(conn), json.NewDecoder(conn)
+	}
+	var reply sidecarReply
+	err := c.enc.Encode(newSpoolRecord(m))
+	if err == nil {
+		err = c.dec.Decode(&reply)
+	}
+	if err != nil {
+		c.disconnect()
+		return err
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("%w: %s", ErrSidecarDelivery, reply.Error)
+	}
+	return nil
+}
+
+// Close closes the connection to the sidecar, if there is one.
+func (c *SidecarClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.disconnect()
+	return nil
+}
+
+func (c *SidecarClient) disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.enc, c.dec = nil, nil, nil
+	}
+}
@@ -0,0 +1,240 @@
+package nsca
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spoolRecord is the on-disk form of a spooled message.
+type spoolRecord struct {
+	Time    time.Time // when the message was spooled
+	State   int16
+	Host    string
+	Service string
+	Message string
+}
+
+// SpoolCodec converts messages to and from the contents of spool files.
+type SpoolCodec interface {
+	Encode(m *Message) ([]byte, error)
+	Decode(b []byte) (*Message, error)
+}
+
+// JSONSpoolCodec stores each message as a JSON object, along with the time it was spooled,
+// so the spool can be inspected and edited by hand. It is the default, and its files have
+// the extension ".json".
+type JSONSpoolCodec struct{}
+
+func (JSONSpoolCodec) Encode(m *Message) ([]byte, error) {
+	return json.Marshal(newSpoolRecord(m))
+}
+
+func (c JSONSpoolCodec) Decode(b []byte) (*Message, error) {
+	r, err := c.decodeRecord(b)
+	if err != nil {
+		return nil, err
+	}
+	return r.message(), nil
+}
+
+func (JSONSpoolCodec) decodeRecord(b []byte) (r spoolRecord, err error) {
+	err = json.Unmarshal(b, &r)
+	return r, err
+}
+
+func (JSONSpoolCodec) extension() string { return ".json" }
+
+// GobSpoolCodec stores each message, along with the time it was spooled, in the compact
+// binary encoding/gob format. Its files have the extension ".gob".
+type GobSpoolCodec struct{}
+
+func (GobSpoolCodec) Encode(m *Message) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(newSpoolRecord(m))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c GobSpoolCodec) Decode(b []byte) (*Message, error) {
+	r, err := c.decodeRecord(b)
+	if err != nil {
+		return nil, err
+	}
+	return r.message(), nil
+}
+
+func (GobSpoolCodec) decodeRecord(b []byte) (r spoolRecord, err error) {
+	err = gob.NewDecoder(bytes.NewReader(b)).Decode(&r)
+	return r, err
+}
+
+func (GobSpoolCodec) extension() string { return ".gob" }
+
+// spoolExtension returns the file extension used for codec's spool files: ".spool" for
+// codecs other than the ones in this package.
+func spoolExtension(codec SpoolCodec) string {
+	if c, ok := codec.(interface{ extension() string }); ok {
+		return c.extension()
+	}
+	return ".spool"
+}
+
+// decodeSpool decodes a spool file with codec, returning the time its message was spooled,
+// or the zero time for codecs other than the ones in this package.
+func decodeSpool(codec SpoolCodec, b []byte) (*Message, time.Time, error) {
+	if c, ok := codec.(interface {
+		decodeRecord([]byte) (spoolRecord, error)
+	}); ok {
+		r, err := c.decodeRecord(b)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return r.message(), r.Time, nil
+	}
+	m, err := codec.Decode(b)
+	return m, time.Time{}, err
+}
+
+func newSpoolRecord(m *Message) spoolRecord {
+	return spoolRecord{
+		Time:    time.Now(),
+		State:   m.State,
+		Host:    m.Host,
+		Service: m.Service,
+		Message: m.Message,
+	}
+}
+
+func (r spoolRecord) message() *Message {
+	return &Message{State: r.State, Host: r.Host, Service: r.Service, Message: r.Message}
+}
+
+// SpoolWriter saves messages to a spool directory so they can be delivered later with
+// ReplaySpool, for example when RunEndpoint reports a failure on a message's Status
+// channel during an outage. Each message is stored in its own file. A SpoolWriter is
+// safe to use from multiple threads.
+type SpoolWriter struct {
+	dir   string
+	codec SpoolCodec
+	mu    sync.Mutex
+	seq   uint64
+}
+
+// NewSpoolWriter creates a SpoolWriter for dir that uses JSONSpoolCodec, creating the
+// directory if needed.
+func NewSpoolWriter(dir string) (*SpoolWriter, error) {
+	return NewSpoolWriterWithCodec(dir, JSONSpoolCodec{})
+}
+
+// NewSpoolWriterWithCodec creates a SpoolWriter for dir that encodes messages with codec,
+// creating the directory if needed. Replay the spool with ReplaySpoolWithCodec and the
+// same codec.
+func NewSpoolWriterWithCodec(dir string, codec SpoolCodec) (*SpoolWriter, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &SpoolWriter{dir: dir, codec: codec}, nil
+}
+
+// Write saves a message to the spool. The Status channel and UserData of the message are
+// not saved.
+func (w *SpoolWriter) Write(m *Message) error {
+	b, err := w.codec.Encode(m)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.seq++
+	// names sort in the order the messages were spooled
+	name := fmt.Sprintf("%020d-%d-%d%s", time.Now().UnixNano(), os.Getpid(), w.seq, spoolExtension(w.codec))
+	w.mu.Unlock()
+	tmp := filepath.Join(w.dir, name+".tmp")
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, filepath.Join(w.dir, name))
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// ReplaySpool sends the messages spooled in dir by a SpoolWriter using JSONSpoolCodec to an
+// NSCA server, oldest first, over a single connection. Each file is removed once its
+// message has been sent. ReplaySpool stops at the first error, leaving the remaining
+// messages in the spool. With info.UseClientTimestamp, each packet carries the time its
+// message was spooled, when the result was produced, rather than the time of the replay;
+// the daemon drops those older than its max_packet_age setting.
+func ReplaySpool(info ServerInfo, dir string) error {
+	return ReplaySpoolWithCodec(info, dir, JSONSpoolCodec{})
+}
+
+// ReplaySpoolWithCodec is ReplaySpool for a spool written with codec. Only the files
+// written with codec are replayed. Codecs other than the ones in this package do not
+// store the spool time, so their messages carry the time of the replay.
+func ReplaySpoolWithCodec(info ServerInfo, dir string, codec SpoolCodec) error {
+	ext := spoolExtension(codec)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ext) {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	server := new(NSCAServer)
+	defer server.Close()
+	send := func(m *Message, spooled time.Time) error {
+		if info.UseClientTimestamp && !spooled.IsZero() {
+			return server.sendAt(m, uint32(spooled.Unix()))
+		}
+		return server.Send(m)
+	}
+	if info.Transport == NRDP {
+		// no connection: each message is its own request
+		send = func(m *Message, _ time.Time) error { return server.sendReconnecting(info, m) }
+	} else {
+		err = server.Connect(info)
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		m, spooled, err := decodeSpool(codec, b)
+		if err != nil {
+			return fmt.Errorf("Bad spool file %s: %s", path, err)
+		}
+		err = send(m, spooled)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package nsca
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSpool(t *testing.T) {
+	testSpool(t, nil)
+}
+
+func TestSpoolTime(t *testing.T) {
+	dir := t.TempDir()
+	record := `{"Time":"2024-01-02T03:04:05Z","State":2,"Host":"host","Service":"svc","Message":"out"}`
+	if err := os.WriteFile(dir+"/1.json", []byte(record), 0600); err != nil {
+		t.Fatalf("Could not spool message: %s", err)
+	}
+	path, received := unixServer(t)
+	// with client timestamps, the packet carries the time the message was spooled
+	err := ReplaySpool(ServerInfo{Network: "unix", Host: path, UseClientTimestamp: true}, dir)
+	if err != nil {
+		t.Fatalf("Error replaying spool: %s", err)
+	}
+	b := <-received
+	if len(b) != 720 {
+		t.Fatalf("Expected 1 packet, got %d bytes", len(b))
+	}
+	p, err := decodeDataPacket(b, newEncryption(ENCRYPT_NONE, make([]byte, 128), ""))
+	if err != nil {
+		t.Fatalf("Error decoding packet: %s", err)
+	}
+	if p.timestamp != uint32(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix()) || p.hostName != "host" ||
+		p.pluginOutput != "out" || p.returnCode != STATE_CRITICAL {
+		t.Errorf("Bad replayed packet %+v", p)
+	}
+}
+
+func TestSpoolGob(t *testing.T) {
+	testSpool(t, GobSpoolCodec{})
+}
+
+// testSpool spools and replays three messages with codec, or with the default JSON
+// functions if codec is nil.
+func testSpool(t *testing.T, codec SpoolCodec) {
+	dir := t.TempDir()
+	var w *SpoolWriter
+	var err error
+	if codec == nil {
+		w, err = NewSpoolWriter(dir)
+	} else {
+		w, err = NewSpoolWriterWithCodec(dir, codec)
+	}
+	if err != nil {
+		t.Fatalf("Could not create spool: %s", err)
+	}
+	for _, s := range []string{"first", "second", "third"} {
+		err = w.Write(&Message{State: STATE_WARNING, Host: "host", Service: "service", Message: s})
+		if err != nil {
+			t.Fatalf("Could not spool message: %s", err)
+		}
+	}
+	path := t.TempDir() + "/nsca.sock"
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(make([]byte, 132))
+		b, _ := io.ReadAll(conn)
+		received <- b
+	}()
+	if codec == nil {
+		err = ReplaySpool(ServerInfo{Network: "unix", Host: path}, dir)
+	} else {
+		err = ReplaySpoolWithCodec(ServerInfo{Network: "unix", Host: path}, dir, codec)
+	}
+	if err != nil {
+		t.Fatalf("Error replaying spool: %s", err)
+	}
+	b := <-received
+	if len(b) != 3*720 {
+		t.Fatalf("Expected 3 packets, got %d bytes", len(b))
+	}
+	enc := newEncryption(ENCRYPT_NONE, make([]byte, 128), "")
+	for i, s := range []string{"first", "second", "third"} {
+		p, err := decodeDataPacket(b[i*720:(i+1)*720], enc)
+		if err != nil {
+			t.Fatalf("Error decoding packet %d: %s", i, err)
+		}
+		if p.pluginOutput != s || p.returnCode != STATE_WARNING {
+			t.Errorf("Bad packet %d: %+v", i, p)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("Spool should be empty, found %d files", len(entries))
+	}
+}
@@ -0,0 +1,109 @@
+package nsca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCert creates a certificate signed by parent (or self-signed if parent is nil).
+func testCert(t *testing.T, name string, isCA bool, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %s", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := testCert(t, "test CA", true, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverCert := testCert(t, "server", false, &ca)
+	clientCert := testCert(t, "client", false, &ca)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	received := make(chan int, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, err := conn.Write(make([]byte, 132))
+				if err != nil {
+					return
+				}
+				n, _ := io.Copy(io.Discard, conn)
+				received <- int(n)
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	info := ServerInfo{
+		Host:      host,
+		Port:      port,
+		Timeout:   5 * time.Second,
+		TLSConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}},
+	}
+	err = Send(info, &Message{State: STATE_OK, Host: "host", Message: "over mTLS"})
+	if err != nil {
+		t.Fatalf("Error sending over mutual TLS: %s", err)
+	}
+	if n := <-received; n != 720 {
+		t.Errorf("Server received %d bytes, expected 720", n)
+	}
+
+	// no client certificate: the server rejects the connection
+	info.TLSConfig = &tls.Config{RootCAs: pool}
+	err = Send(info, &Message{State: STATE_OK, Host: "host"})
+	if err == nil {
+		t.Errorf("Send without a client certificate should have failed")
+	}
+
+	// untrusted server certificate
+	info.TLSConfig = &tls.Config{Certificates: []tls.Certificate{clientCert}}
+	err = Ping(info)
+	if !errors.Is(err, ErrTLSHandshake) {
+		t.Errorf("Expected ErrTLSHandshake, got %v", err)
+	}
+}
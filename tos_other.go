@@ -0,0 +1,12 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package nsca
+
+import (
+	"fmt"
+	"net"
+)
+
+func setTOS(conn net.Conn, tos int) error {
+	return fmt.Errorf("Setting TOS is not supported on this platform")
+}
@@ -0,0 +1,33 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package nsca
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// setTOS sets the IP type-of-service (IPv4) or traffic class (IPv6) byte on a TCP connection.
+func setTOS(conn net.Conn, tos int) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return fmt.Errorf("TOS can only be set on a TCP connection")
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+	if addr, ok := tcp.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, tos)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
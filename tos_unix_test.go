@@ -0,0 +1,43 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package nsca
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestTOS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(make([]byte, 132))
+		conn.Read(make([]byte, 1))
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	n := new(NSCAServer)
+	if err := n.Connect(ServerInfo{Host: "127.0.0.1", Port: port, TOS: 0x20}); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	defer n.Close()
+	raw, err := n.conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("Error getting the socket: %s", err)
+	}
+	var tos int
+	raw.Control(func(fd uintptr) {
+		tos, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	if err != nil || tos != 0x20 {
+		t.Errorf("Expected TOS 0x20, got %#x, %v", tos, err)
+	}
+}
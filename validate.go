@@ -0,0 +1,165 @@
+package nsca
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidState is the reason ValidateBatch gives for a message whose State is not one
+// of STATE_OK, STATE_WARNING, STATE_CRITICAL or STATE_UNKNOWN.
+var ErrInvalidState = errors.New("Invalid message state")
+
+// ErrFieldTooLong is the reason ValidateBatch gives for a message with a field that does
+// not fit in its packet field and would be truncated when sent.
+var ErrFieldTooLong = errors.New("Message field too long")
+
+// ErrNilMessage is the reason ValidateBatch gives for a nil entry.
+var ErrNilMessage = errors.New("Nil message")
+
+// BatchError is returned by ValidateBatch for the first invalid message in a batch.
+type BatchError struct {
+	// Index is the position of the message in the batch.
+	Index int
+	// Err is the reason: ErrNilMessage, ErrInvalidState or ErrFieldTooLong, wrapped with
+	// details.
+	Err error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("Invalid message %d in batch: %s", e.Index, e.Err)
+}
+
+// Unwrap returns the reason the message is invalid.
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateBatch checks every message in a batch before anything is sent, so a caller can
+// reject the whole batch instead of sending it with a gap or a silently truncated field.
+// It returns a *BatchError for the first invalid message, or nil if all are valid. Host
+// names, service descriptions and plugin output must fit in their fields, leaving room
+// for the terminating NUL.
+func ValidateBatch(messages []*Message) error {
+	for i, m := range messages {
+		err := validateMessage(m)
+		if err != nil {
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+	return nil
+}
+
+func validateMessage(m *Message) error {
+	if m == nil {
+		return ErrNilMessage
+	}
+	if m.State < STATE_OK || m.State > STATE_UNKNOWN {
+		return fmt.Errorf("%w %d", ErrInvalidState, m.State)
+	}
+	for _, field := range []struct {
+		name  string
+		value string
+		max   int
+	}{
+		{"host name", m.Host, HostNameLength - 1},
+		{"service description", m.Service, ServiceLength - 1},
+		{"plugin output", m.Message, PluginOutputLength - 1},
+	} {
+		if len(field.value) > field.max {
+			return fmt.Errorf("%w: %s is %d bytes, the maximum is %d", ErrFieldTooLong, field.name, len(field.value), field.max)
+		}
+	}
+	return nil
+}
+
+// ErrInvalidConfig is returned, wrapped with the problem, by ServerInfo.Validate.
+var ErrInvalidConfig = errors.New("Invalid NSCA configuration")
+
+// Validate checks s as a whole, the way a configuration loader would before starting an
+// endpoint, and returns the first problem found, or nil. It checks that the server's
+// address is complete (a numeric Port for the TCP networks, a socket path for "unix", a
+// URL for NRDP), that Network is known, that EncryptionMethod is supported and has a
+// password, that a password is not sent in the clear under StrictConfig, and that no
+// duration or count is negative.
+// Problems with the encryption are reported as ErrEncryptionUnsupported, ErrEmptyPassword
+// or ErrInsecureConfig, and the rest wrap ErrInvalidConfig. Validate does not connect, so
+// it cannot tell whether the server is reachable or the password right; see Diagnose.
+func (s ServerInfo) Validate() error {
+	switch {
+	case s.Transport == NRDP:
+		u, err := url.Parse(s.Host)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: NRDP Host %q is not an http or https URL", ErrInvalidConfig, s.Host)
+		}
+		if s.Password == "" && s.PasswordFile == "" {
+			return fmt.Errorf("%w: NRDP needs its token as Password", ErrInvalidConfig)
+		}
+	case s.Transport != NSCA:
+		return fmt.Errorf("%w: unknown Transport %d", ErrInvalidConfig, s.Transport)
+	case s.DryRun:
+	case registeredTransport(s.network()) != nil:
+	case s.network() == "unix":
+		if s.Host == "" {
+			return fmt.Errorf("%w: Host must be the socket path for the unix network", ErrInvalidConfig)
+		}
+	case s.network() == "tcp" || s.network() == "tcp4" || s.network() == "tcp6":
+		if port, err := strconv.Atoi(s.Port); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("%w: Port %q is not a number from 1 to 65535", ErrInvalidConfig, s.Port)
+		}
+	default:
+		return fmt.Errorf("%w: unknown Network %q", ErrInvalidConfig, s.Network)
+	}
+	if s.Transport == NSCA {
+		if !IsEncryptionSupported(s.EncryptionMethod) {
+			return fmt.Errorf("%w %d (%s)", ErrEncryptionUnsupported, s.EncryptionMethod,
+				encryptionNames[s.EncryptionMethod])
+		}
+		hasPassword := s.Password != "" || s.PasswordFile != ""
+		if s.EncryptionMethod != ENCRYPT_NONE && !hasPassword {
+			return ErrEmptyPassword
+		}
+		if s.EncryptionMethod == ENCRYPT_NONE && hasPassword && s.StrictConfig {
+			return ErrInsecureConfig
+		}
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"Timeout", s.Timeout},
+		{"OverallTimeout", s.OverallTimeout},
+		{"IdleTimeout", s.IdleTimeout},
+		{"HeartbeatInterval", s.HeartbeatInterval},
+		{"MinInterval", s.MinInterval},
+		{"BreakerCooldown", s.BreakerCooldown},
+		{"MinReconnectInterval", s.MinReconnectInterval},
+	} {
+		if d.value < 0 {
+			return fmt.Errorf("%w: %s is negative (%s)", ErrInvalidConfig, d.name, d.value)
+		}
+	}
+	for _, n := range []struct {
+		name  string
+		value int
+	}{
+		{"MaxBatchSize", s.MaxBatchSize},
+		{"MaxConcurrentSends", s.MaxConcurrentSends},
+		{"MaxOutputBytes", s.MaxOutputBytes},
+		{"MaxRetries", s.MaxRetries},
+		{"BreakerThreshold", s.BreakerThreshold},
+	} {
+		if n.value < 0 {
+			return fmt.Errorf("%w: %s is negative (%d)", ErrInvalidConfig, n.name, n.value)
+		}
+	}
+	if s.TOS < 0 || s.TOS > 255 {
+		return fmt.Errorf("%w: TOS %d is not a byte", ErrInvalidConfig, s.TOS)
+	}
+	if s.HeartbeatInterval > 0 && s.Heartbeat == nil {
+		return fmt.Errorf("%w: HeartbeatInterval is set without a Heartbeat message", ErrInvalidConfig)
+	}
+	return nil
+}